@@ -0,0 +1,186 @@
+package assembler
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/sato11/the-hack-vm-translator/parser"
+)
+
+// MaxAddress is the largest value an A-instruction can load.
+const MaxAddress = 32767
+
+// VariableBase is the address the first variable symbol is allocated at.
+const VariableBase = 16
+
+// Program is Hack machine code along with the symbols it was assembled with.
+type Program struct {
+	// Instructions are the machine instructions to be loaded into ROM.
+	Instructions []uint16
+	// Symbols holds the predefined symbols, labels and variables of the program.
+	Symbols *SymbolTable
+}
+
+// line is a single instruction or label with whitespaces and comments removed.
+type line struct {
+	text string
+	pos  parser.Position
+}
+
+// IsSymbol reports whether name is a valid symbol, that is a sequence of letters, digits,
+// underscores, dots, dollar signs and colons not beginning with a digit.
+func IsSymbol(name string) bool {
+	if name == "" || ('0' <= name[0] && name[0] <= '9') {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '_', c == '.', c == '$', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// readLines reads the instructions and labels of the assembly code in r.
+func readLines(filename string, r io.Reader) ([]line, error) {
+	var lines []line
+	scanner := bufio.NewScanner(r)
+	for number := 1; scanner.Scan(); number++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "//"); i >= 0 {
+			text = text[:i] // remove comments
+		}
+		column := len(text) - len(strings.TrimLeft(text, " \t")) + 1
+		text = strings.Join(strings.Fields(text), "") // remove whitespaces
+		if text != "" {
+			lines = append(lines, line{text, parser.Position{Filename: filename, Line: number, Column: column}})
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// Assemble translates the Hack assembly code read from r into machine code.
+// Labels are resolved in a first pass, so that they can be referred to before being declared,
+// and the remaining symbols are allocated as variables from address 16 in a second pass.
+// filename is used for the positions of the errors, which are returned together as a parser.ErrorList.
+func Assemble(filename string, r io.Reader) (*Program, error) {
+	lines, err := readLines(filename, r)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs parser.ErrorList
+	symbols := NewSymbolTable()
+
+	// first pass: labels
+	address := 0
+	for _, l := range lines {
+		if !strings.HasPrefix(l.text, "(") {
+			address++
+			continue
+		}
+		label := strings.TrimSuffix(strings.TrimPrefix(l.text, "("), ")")
+		switch {
+		case !strings.HasSuffix(l.text, ")") || !IsSymbol(label):
+			errs.Add(l.pos, fmt.Errorf("invalid label %q", l.text))
+		case IsPredefined(label):
+			errs.Add(l.pos, fmt.Errorf("label %s redefines a predefined symbol", label))
+		case symbols.Contains(label):
+			errs.Add(l.pos, fmt.Errorf("label %s defined more than once", label))
+		case address > MaxAddress+1:
+			errs.Add(l.pos, fmt.Errorf("label %s is out of the ROM", label))
+		default:
+			symbols.AddEntry(label, uint16(address))
+		}
+	}
+
+	// second pass: instructions
+	var instructions []uint16
+	variable := uint16(VariableBase)
+	for _, l := range lines {
+		switch {
+		case strings.HasPrefix(l.text, "("):
+			continue
+
+		case strings.HasPrefix(l.text, "@"):
+			value := l.text[1:]
+			if n, err := strconv.Atoi(value); err == nil {
+				if n < 0 || n > MaxAddress {
+					errs.Add(l.pos, fmt.Errorf("constant %d out of range 0-%d", n, MaxAddress))
+				}
+				instructions = append(instructions, uint16(n))
+				continue
+			}
+			if !IsSymbol(value) {
+				errs.Add(l.pos, fmt.Errorf("invalid symbol %q", value))
+				instructions = append(instructions, 0)
+				continue
+			}
+			if !symbols.Contains(value) {
+				symbols.AddEntry(value, variable)
+				variable++
+			}
+			instructions = append(instructions, symbols.GetAddress(value))
+
+		default:
+			instruction, err := EncodeC(l.text)
+			if err != nil {
+				errs.Add(l.pos, err)
+			}
+			instructions = append(instructions, instruction)
+		}
+	}
+
+	if len(instructions) > MaxAddress+1 {
+		errs.Add(parser.Position{Filename: filename}, errors.New("program does not fit into the ROM"))
+	}
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	return &Program{instructions, symbols}, nil
+}
+
+// WriteHack writes the program as text, one instruction of 16 binary digits per line.
+func (p *Program) WriteHack(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	for _, instruction := range p.Instructions {
+		if _, err := fmt.Fprintf(b, "%016b\n", instruction); err != nil {
+			return err
+		}
+	}
+	return b.Flush()
+}
+
+// ReadHack reads a program written by WriteHack.
+// The returned program has no symbols other than the predefined ones.
+func ReadHack(filename string, r io.Reader) (*Program, error) {
+	var instructions []uint16
+	var errs parser.ErrorList
+	scanner := bufio.NewScanner(r)
+	for number := 1; scanner.Scan(); number++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		instruction, err := strconv.ParseUint(text, 2, 16)
+		if err != nil || len(text) != 16 {
+			errs.Add(parser.Position{Filename: filename, Line: number, Column: 1}, fmt.Errorf("invalid instruction %q", text))
+			continue
+		}
+		instructions = append(instructions, uint16(instruction))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	return &Program{instructions, NewSymbolTable()}, nil
+}
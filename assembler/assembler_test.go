@@ -0,0 +1,233 @@
+package assembler
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sato11/the-hack-vm-translator/codewriter"
+	"github.com/sato11/the-hack-vm-translator/parser"
+)
+
+type assembleTest struct {
+	source string
+	hack   []string
+}
+
+func TestAssemble(t *testing.T) {
+	tests := []assembleTest{
+		// Add.asm
+		{
+			"@2\nD=A\n@3\nD=D+A\n@0\nM=D\n",
+			[]string{
+				"0000000000000010",
+				"1110110000010000",
+				"0000000000000011",
+				"1110000010010000",
+				"0000000000000000",
+				"1110001100001000",
+			},
+		},
+		// Max.asm
+		{
+			strings.Join([]string{
+				"// Computes R2 = max(R0, R1)",
+				"   @R0",
+				"   D=M              // D = first number",
+				"   @R1",
+				"   D=D-M            // D = first number - second number",
+				"   @OUTPUT_FIRST",
+				"   D;JGT            // if D>0 (first is greater) goto output_first",
+				"   @R1",
+				"   D=M              // D = second number",
+				"   @OUTPUT_D",
+				"   0;JMP            // goto output_d",
+				"(OUTPUT_FIRST)",
+				"   @R0",
+				"   D=M              // D = first number",
+				"(OUTPUT_D)",
+				"   @R2",
+				"   M=D              // M[2] = D (greatest number)",
+				"(INFINITE_LOOP)",
+				"   @INFINITE_LOOP",
+				"   0;JMP            // infinite loop",
+			}, "\n"),
+			[]string{
+				"0000000000000000",
+				"1111110000010000",
+				"0000000000000001",
+				"1111010011010000",
+				"0000000000001010",
+				"1110001100000001",
+				"0000000000000001",
+				"1111110000010000",
+				"0000000000001100",
+				"1110101010000111",
+				"0000000000000000",
+				"1111110000010000",
+				"0000000000000010",
+				"1110001100001000",
+				"0000000000001110",
+				"1110101010000111",
+			},
+		},
+		// variables, function labels and return addresses
+		{
+			"@Main.0\nM=0\n@Main.main$LOOP\n0;JMP\n(Main.main$LOOP)\n@Main.1\nAM=M-1\n@Main.0\n(Sys.init.return.0)\n@Sys.init.return.0\n@SCREEN\n@KBD",
+			[]string{
+				"0000000000010000",
+				"1110101010001000",
+				"0000000000000100",
+				"1110101010000111",
+				"0000000000010001",
+				"1111110010101000",
+				"0000000000010000",
+				"0000000000000111",
+				"0100000000000000",
+				"0110000000000000",
+			},
+		},
+	}
+
+	for i, test := range tests {
+		program, err := Assemble("Test.asm", strings.NewReader(test.source))
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+
+		var b bytes.Buffer
+		if err := program.WriteHack(&b); err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		expected := strings.Join(test.hack, "\n") + "\n"
+		if b.String() != expected {
+			t.Errorf("#%d: got: %v wanted: %v", i, b.String(), expected)
+		}
+	}
+}
+
+func TestAssembleSymbols(t *testing.T) {
+	program, err := Assemble("Test.asm", strings.NewReader("@x\n(LOOP)\n@y\n@x\n@LOOP\n0;JMP"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	symbols := map[string]uint16{"x": 16, "y": 17, "LOOP": 1, "SP": 0, "R15": 15}
+	for symbol, address := range symbols {
+		if !program.Symbols.Contains(symbol) || program.Symbols.GetAddress(symbol) != address {
+			t.Errorf("%s: got: %v wanted: %v", symbol, program.Symbols.GetAddress(symbol), address)
+		}
+	}
+}
+
+type assembleErrorTest struct {
+	source string
+	errs   []string
+}
+
+func TestAssembleErrors(t *testing.T) {
+	tests := []assembleErrorTest{
+		{"@32768", []string{"Test.asm:1:1: constant 32768 out of range 0-32767"}},
+		{"@1abc", []string{`Test.asm:1:1: invalid symbol "1abc"`}},
+		{"D=X", []string{`Test.asm:1:1: invalid comp "X"`}},
+		{"Q=D", []string{`Test.asm:1:1: invalid dest "Q"`}},
+		{"DD=1", []string{`Test.asm:1:1: invalid dest "DD"`}},
+		{"0;JUMP", []string{`Test.asm:1:1: invalid jump "JUMP"`}},
+		{"(LOOP", []string{`Test.asm:1:1: invalid label "(LOOP"`}},
+		{"(SP)", []string{"Test.asm:1:1: label SP redefines a predefined symbol"}},
+		{"(LOOP)\n  (LOOP)", []string{"Test.asm:2:3: label LOOP defined more than once"}},
+		{"D=X\n@1\nD;JUMP", []string{`Test.asm:1:1: invalid comp "X"`, `Test.asm:3:1: invalid jump "JUMP"`}},
+	}
+
+	for i, test := range tests {
+		_, err := Assemble("Test.asm", strings.NewReader(test.source))
+		errs, ok := err.(parser.ErrorList)
+		if !ok {
+			t.Errorf("#%d: got: %v wanted: %v", i, err, test.errs)
+			continue
+		}
+		if len(errs) != len(test.errs) {
+			t.Errorf("#%d: got: %v wanted: %v", i, errs, test.errs)
+			continue
+		}
+		for j := range errs {
+			if errs[j].Error() != test.errs[j] {
+				t.Errorf("#%d-%d: got: %v wanted: %v", i, j, errs[j].Error(), test.errs[j])
+			}
+		}
+	}
+}
+
+func TestAssembleTranslation(t *testing.T) {
+	source := strings.Join([]string{
+		"function Sys.init 0",
+		"push constant 1",
+		"push constant 2",
+		"eq",
+		"push constant 3",
+		"lt",
+		"push constant 4",
+		"gt",
+		"pop static 0",
+		"call Sys.main 0",
+		"label WHILE",
+		"goto WHILE",
+		"function Sys.main 1",
+		"push local 0",
+		"if-goto END",
+		"label END",
+		"return",
+	}, "\n")
+	file, err := parser.ParseFile("Sys.vm", strings.NewReader(source))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var asm bytes.Buffer
+	c := codewriter.NewWriter(&asm)
+	if err := c.WriteProgram([]*parser.File{file}, codewriter.BootstrapAlways); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c.Flush()
+
+	program, err := Assemble("Sys.asm", &asm)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, label := range []string{"Sys.init", "Sys.main", "Sys.init$WHILE", "Sys.main$END", "$$bootstrap$Sys.init.return.0", "$Sys$Sys.main.return.0", "$Sys$CHECKEQ0", "$Sys$ISGT0", "$Sys$LTEND0"} {
+		if !program.Symbols.Contains(label) {
+			t.Errorf("got: no symbol wanted: label %s", label)
+		}
+	}
+	if !program.Symbols.Contains("Sys.0") || program.Symbols.GetAddress("Sys.0") != VariableBase {
+		t.Errorf("got: %v wanted: %v", program.Symbols.GetAddress("Sys.0"), VariableBase)
+	}
+}
+
+func TestReadHack(t *testing.T) {
+	program, err := Assemble("Test.asm", strings.NewReader("@x\n(LOOP)\nM=M+1\n@LOOP\n0;JMP"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var b bytes.Buffer
+	program.WriteHack(&b)
+
+	read, err := ReadHack("Test.hack", &b)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(read.Instructions) != len(program.Instructions) {
+		t.Fatalf("got: %v wanted: %v", read.Instructions, program.Instructions)
+	}
+	for i := range read.Instructions {
+		if read.Instructions[i] != program.Instructions[i] {
+			t.Errorf("#%d: got: %v wanted: %v", i, read.Instructions[i], program.Instructions[i])
+		}
+	}
+
+	_, err = ReadHack("Test.hack", strings.NewReader("0000000000000001\n000000000000001\n000000000000000x\n"))
+	expected := "Test.hack:2:1: invalid instruction \"000000000000001\"\nTest.hack:3:1: invalid instruction \"000000000000000x\""
+	if err == nil || err.Error() != expected {
+		t.Errorf("got: %v wanted: %v", err, expected)
+	}
+}
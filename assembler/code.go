@@ -0,0 +1,138 @@
+package assembler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// comps maps the comp mnemonics onto their 7 bits, including the a-bit.
+var comps = map[string]uint16{
+	"0":   0x2a, // 0101010
+	"1":   0x3f, // 0111111
+	"-1":  0x3a, // 0111010
+	"D":   0x0c, // 0001100
+	"A":   0x30, // 0110000
+	"!D":  0x0d, // 0001101
+	"!A":  0x31, // 0110001
+	"-D":  0x0f, // 0001111
+	"-A":  0x33, // 0110011
+	"D+1": 0x1f, // 0011111
+	"A+1": 0x37, // 0110111
+	"D-1": 0x0e, // 0001110
+	"A-1": 0x32, // 0110010
+	"D+A": 0x02, // 0000010
+	"D-A": 0x13, // 0010011
+	"A-D": 0x07, // 0000111
+	"D&A": 0x00, // 0000000
+	"D|A": 0x15, // 0010101
+	"M":   0x70, // 1110000
+	"!M":  0x71, // 1110001
+	"-M":  0x73, // 1110011
+	"M+1": 0x77, // 1110111
+	"M-1": 0x72, // 1110010
+	"D+M": 0x42, // 1000010
+	"D-M": 0x53, // 1010011
+	"M-D": 0x47, // 1000111
+	"D&M": 0x40, // 1000000
+	"D|M": 0x55, // 1010101
+}
+
+// commuted holds the alternative spellings of commutative comp mnemonics.
+var commuted = map[string]string{
+	"1+D": "D+1",
+	"1+A": "A+1",
+	"1+M": "M+1",
+	"A+D": "D+A",
+	"A&D": "D&A",
+	"A|D": "D|A",
+	"M+D": "D+M",
+	"M&D": "D&M",
+	"M|D": "D|M",
+}
+
+var jumps = map[string]uint16{
+	"":    0,
+	"JGT": 1,
+	"JEQ": 2,
+	"JGE": 3,
+	"JLT": 4,
+	"JNE": 5,
+	"JLE": 6,
+	"JMP": 7,
+}
+
+// Dest returns the 3 bits of the dest mnemonic, which is any combination of A, D and M.
+func Dest(mnemonic string) (uint16, error) {
+	var bits uint16
+	for _, c := range mnemonic {
+		var bit uint16
+		switch c {
+		case 'A':
+			bit = 4
+		case 'D':
+			bit = 2
+		case 'M':
+			bit = 1
+		default:
+			return 0, fmt.Errorf("invalid dest %q", mnemonic)
+		}
+		if bits&bit != 0 {
+			return 0, fmt.Errorf("invalid dest %q", mnemonic)
+		}
+		bits |= bit
+	}
+	return bits, nil
+}
+
+// Comp returns the 7 bits of the comp mnemonic.
+func Comp(mnemonic string) (uint16, error) {
+	if canonical, ok := commuted[mnemonic]; ok {
+		mnemonic = canonical
+	}
+	bits, ok := comps[mnemonic]
+	if !ok {
+		return 0, fmt.Errorf("invalid comp %q", mnemonic)
+	}
+	return bits, nil
+}
+
+// Jump returns the 3 bits of the jump mnemonic.
+func Jump(mnemonic string) (uint16, error) {
+	bits, ok := jumps[mnemonic]
+	if !ok {
+		return 0, fmt.Errorf("invalid jump %q", mnemonic)
+	}
+	return bits, nil
+}
+
+// EncodeC returns the machine code of the C-instruction dest=comp;jump,
+// where either of the = and ; parts may be omitted.
+func EncodeC(instruction string) (uint16, error) {
+	dest, comp, jump := "", instruction, ""
+	if i := strings.Index(comp, "="); i >= 0 {
+		dest, comp = comp[:i], comp[i+1:]
+		if dest == "" {
+			return 0, fmt.Errorf("invalid dest %q", dest)
+		}
+	}
+	if i := strings.Index(comp, ";"); i >= 0 {
+		comp, jump = comp[:i], comp[i+1:]
+		if jump == "" {
+			return 0, fmt.Errorf("invalid jump %q", jump)
+		}
+	}
+
+	d, err := Dest(dest)
+	if err != nil {
+		return 0, err
+	}
+	c, err := Comp(comp)
+	if err != nil {
+		return 0, err
+	}
+	j, err := Jump(jump)
+	if err != nil {
+		return 0, err
+	}
+	return 0xe000 | c<<6 | d<<3 | j, nil
+}
@@ -0,0 +1,50 @@
+package assembler
+
+import "testing"
+
+type encodeCTest struct {
+	instruction string
+	out         uint16
+}
+
+func TestEncodeC(t *testing.T) {
+	tests := []encodeCTest{
+		{"0", 0xea80},
+		{"M=1", 0xefc8},
+		{"D=-1", 0xee90},
+		{"A=D", 0xe320},
+		{"AM=M-1", 0xfca8},
+		{"MD=M+1", 0xfdd8},
+		{"AMD=A", 0xec38},
+		{"DM=D|M", 0xf558},
+		{"M=D+M", 0xf088},
+		{"M=M+D", 0xf088},
+		{"D=D&A", 0xe010},
+		{"D=A&D", 0xe010},
+		{"A=M-D", 0xf1e0},
+		{"D;JEQ", 0xe302},
+		{"D;JGE", 0xe303},
+		{"D;JLT", 0xe304},
+		{"D;JNE", 0xe305},
+		{"D;JLE", 0xe306},
+		{"M=!M", 0xfc48},
+	}
+
+	for i, test := range tests {
+		out, err := EncodeC(test.instruction)
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		} else if out != test.out {
+			t.Errorf("#%d: got: %016b wanted: %016b", i, out, test.out)
+		}
+	}
+}
+
+func TestEncodeCError(t *testing.T) {
+	instructions := []string{"", "=D", "D;", "D=", "X=D", "D=D*A", "0;JMPX", "ADMA=0"}
+	for i, instruction := range instructions {
+		if _, err := EncodeC(instruction); err == nil {
+			t.Errorf("#%d: got: nil wanted: error for %q", i, instruction)
+		}
+	}
+}
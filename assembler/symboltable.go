@@ -0,0 +1,48 @@
+package assembler
+
+import "fmt"
+
+// SymbolTable keeps a correspondence between symbolic labels and numeric addresses.
+type SymbolTable struct {
+	addresses map[string]uint16
+}
+
+// NewSymbolTable creates a symbol table holding the predefined symbols of the Hack platform.
+func NewSymbolTable() *SymbolTable {
+	addresses := map[string]uint16{
+		"SP":     0,
+		"LCL":    1,
+		"ARG":    2,
+		"THIS":   3,
+		"THAT":   4,
+		"SCREEN": 16384,
+		"KBD":    24576,
+	}
+	for i := uint16(0); i < 16; i++ {
+		addresses[fmt.Sprintf("R%d", i)] = i
+	}
+
+	return &SymbolTable{addresses}
+}
+
+// AddEntry adds the pair (symbol, address) to the table.
+func (s *SymbolTable) AddEntry(symbol string, address uint16) {
+	s.addresses[symbol] = address
+}
+
+// Contains reports whether the table contains the given symbol.
+func (s *SymbolTable) Contains(symbol string) bool {
+	_, ok := s.addresses[symbol]
+	return ok
+}
+
+// GetAddress returns the address associated with the symbol.
+// Should be called only if Contains(symbol) is true.
+func (s *SymbolTable) GetAddress(symbol string) uint16 {
+	return s.addresses[symbol]
+}
+
+// IsPredefined reports whether symbol is one of the symbols predefined by the Hack platform.
+func IsPredefined(symbol string) bool {
+	return NewSymbolTable().Contains(symbol)
+}
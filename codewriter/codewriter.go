@@ -1,9 +1,10 @@
 package codewriter
 
 import (
+	"bufio"
 	"bytes"
-	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 
@@ -19,12 +20,27 @@ type CodeWriter struct {
 	eqIndex      int
 	gtIndex      int
 	ltIndex      int
-	writer       *bytes.Buffer
+	writer       *bufio.Writer
+	buffer       *bytes.Buffer
+	err          error
+	shared       bool
+	routines     map[string]bool
+	optimize     bool
+	instructions []Instruction
+	entry        string
 }
 
-// New opens file in write mode to write translations into.
+// New creates a code writer which keeps translations in memory until Save writes them to file.
 func New() *CodeWriter {
 	var buffer bytes.Buffer
+	c := NewWriter(&buffer)
+	c.buffer = &buffer
+	return c
+}
+
+// NewWriter creates a code writer which streams translations into w as they are generated.
+// Flush must be called once the translation is complete.
+func NewWriter(w io.Writer) *CodeWriter {
 	return &CodeWriter{
 		"",
 		"",
@@ -33,19 +49,138 @@ func New() *CodeWriter {
 		0,
 		0,
 		0,
-		&buffer,
+		bufio.NewWriter(w),
+		nil,
+		nil,
+		false,
+		make(map[string]bool),
+		false,
+		nil,
+		"Sys.init",
 	}
 }
 
-// Setup provides bootstrap codes for codewriter.
-func (c *CodeWriter) Setup() {
+// CommandError is returned when a command cannot be translated.
+type CommandError struct {
+	Command string
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("codewriter: cannot translate command %q", e.Command)
+}
+
+// SegmentError is returned when a push or pop cannot be translated
+// because of its segment or index.
+type SegmentError struct {
+	Command parser.CommandTypes
+	Segment string
+	Index   int
+}
+
+func (e *SegmentError) Error() string {
+	return fmt.Sprintf("codewriter: cannot translate %s %s %d", e.Command, e.Segment, e.Index)
+}
+
+// write appends code to the output unless an error has already occurred.
+// When optimizing, code is held back as instructions until Flush.
+func (c *CodeWriter) write(code string) error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.optimize {
+		c.instructions = append(c.instructions, ParseAssembly(code)...)
+		return nil
+	}
+	_, c.err = c.writer.WriteString(code)
+	return c.err
+}
+
+// SetOptimize selects whether the translation goes through the Peephole optimizer.
+// The optimizer works on the whole translation, so nothing is written before Flush.
+func (c *CodeWriter) SetOptimize(optimize bool) {
+	c.optimize = optimize
+}
+
+// fail records err as the first error of the code writer, if there is none yet, and returns it.
+func (c *CodeWriter) fail(err error) error {
+	if c.err == nil {
+		c.err = err
+	}
+	return err
+}
+
+// Err returns the first error encountered by the code writer, if any.
+func (c *CodeWriter) Err() error {
+	return c.err
+}
+
+// SetEntry selects the function the bootstrap code calls, Sys.init unless told otherwise.
+func (c *CodeWriter) SetEntry(functionName string) {
+	c.entry = functionName
+}
+
+// bootstrapNamespace is the namespace of the labels of the bootstrap code, which no file can have.
+const bootstrapNamespace = "$bootstrap"
+
+// Setup provides bootstrap codes for codewriter, which call the entry function.
+// Its labels are in a namespace of their own, whichever file the code writer is dealing with.
+func (c *CodeWriter) Setup() error {
 	initializeSP := "@256\n" +
 		"D=A\n" +
 		"@SP\n" +
 		"M=D\n"
 
-	c.writer.WriteString(initializeSP)
-	c.WriteCall("Sys.init", 0)
+	if err := c.write(initializeSP); err != nil {
+		return err
+	}
+	namespace, functionName := c.namespace, c.functionName
+	c.namespace, c.functionName = bootstrapNamespace, ""
+	defer func() { c.namespace, c.functionName = namespace, functionName }()
+	return c.WriteCall(c.entry, 0)
+}
+
+// Bootstrap selects whether WriteProgram emits the bootstrap code of Setup.
+type Bootstrap int
+
+const (
+	// BootstrapAuto emits bootstrap code only if the program defines the entry function.
+	BootstrapAuto Bootstrap = iota
+	// BootstrapAlways always emits bootstrap code.
+	BootstrapAlways
+	// BootstrapNever never emits bootstrap code.
+	BootstrapNever
+)
+
+// definesFunction reports whether any of files defines the function named functionName.
+func definesFunction(files []*parser.File, functionName string) bool {
+	for _, file := range files {
+		for _, command := range file.Commands {
+			if command.Type == parser.FunctionCommand && command.Name == functionName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WriteProgram writes the translation of files as a single program,
+// preceded by bootstrap code as selected by bootstrap.
+func (c *CodeWriter) WriteProgram(files []*parser.File, bootstrap Bootstrap) error {
+	if bootstrap == BootstrapAlways || (bootstrap == BootstrapAuto && definesFunction(files, c.entry)) {
+		if err := c.Setup(); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range files {
+		c.SetNamespace(file.Namespace)
+		for _, command := range file.Commands {
+			if err := c.WriteCommand(command); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 // SetFileName informs the code writer that the translation is started.
@@ -59,46 +194,171 @@ func (c *CodeWriter) SetFunctionName(functionName string) {
 }
 
 // SetNamespace informs which individual .vm file the codewriter is dealing with.
+// The commands of the file preceding its first function are outside of any function.
 func (c *CodeWriter) SetNamespace(namespace string) {
 	c.namespace = namespace
+	c.functionName = ""
+}
+
+// SetSharedRoutines selects whether call, return, eq, gt and lt are translated into jumps to routines
+// shared by the whole program instead of being expanded inline, which makes the translation much smaller
+// at the cost of a few instructions per command at run time.
+// Each routine is written once, where it is first needed, behind a jump over it.
+func (c *CodeWriter) SetSharedRoutines(shared bool) {
+	c.shared = shared
+}
+
+// Labels of the shared routines. Labels of the translation made of an identifier, a dollar sign
+// and an identifier cannot clash with them, nor can function names.
+const (
+	callRoutine   = "$$CALL"
+	returnRoutine = "$$RETURN"
+)
+
+// compareRoutine returns the label of the shared routine of the comparison command.
+func compareRoutine(command string) string {
+	return "$$" + strings.ToUpper(command)
 }
 
-func binaryCommandOperator(command string) string {
+// writeRoutine writes the shared routine named label with the given code unless it has been written already,
+// behind a jump over it.
+func (c *CodeWriter) writeRoutine(label, code string) error {
+	if c.routines[label] {
+		return nil
+	}
+	c.routines[label] = true
+
+	return c.write(fmt.Sprintf("@%s.END\n", label) +
+		"0;JMP\n" +
+		fmt.Sprintf("(%s)\n", label) +
+		code +
+		fmt.Sprintf("(%s.END)\n", label))
+}
+
+// compareRoutineCode returns the code of the shared routine of the comparison command,
+// which replaces the two values on top of the stack with the result of their comparison,
+// then jumps to the address held by D.
+func compareRoutineCode(command string) string {
+	label := compareRoutine(command)
+
+	// R15 = return address, R13 = y
+	code := "@R15\n" +
+		"M=D\n" +
+		"@SP\n" +
+		"M=M-1\n" +
+		"A=M\n" +
+		"D=M\n" +
+		"@R13\n" +
+		"M=D\n" +
+		"@SP\n" +
+		"M=M-1\n"
+
+	if command != "eq" {
+		// x-y overflows when x and y have opposite signs, so the sign of x decides then.
+		positiveX, negativeX := label+".TRUE", label+".FALSE"
+		if command == "lt" {
+			positiveX, negativeX = negativeX, positiveX
+		}
+		code += "A=M\n" +
+			"D=M\n" +
+			fmt.Sprintf("@%s.NEGATIVE\n", label) +
+			"D;JLT\n" +
+			"@R13\n" +
+			"D=M\n" +
+			fmt.Sprintf("@%s\n", positiveX) +
+			"D;JLT\n" +
+			fmt.Sprintf("@%s.SAMESIGN\n", label) +
+			"0;JMP\n" +
+			fmt.Sprintf("(%s.NEGATIVE)\n", label) +
+			"@R13\n" +
+			"D=M\n" +
+			fmt.Sprintf("@%s\n", negativeX) +
+			"D;JGE\n" +
+			fmt.Sprintf("(%s.SAMESIGN)\n", label)
+	}
+
+	// D = x-y
+	code += "@R13\n" +
+		"D=M\n" +
+		"@SP\n" +
+		"A=M\n" +
+		"D=M-D\n" +
+		fmt.Sprintf("@%s.TRUE\n", label) +
+		fmt.Sprintf("D;J%s\n", strings.ToUpper(command)) +
+		fmt.Sprintf("(%s.FALSE)\n", label) +
+		"D=0\n" +
+		fmt.Sprintf("@%s.PUSH\n", label) +
+		"0;JMP\n" +
+		fmt.Sprintf("(%s.TRUE)\n", label) +
+		"D=-1\n" +
+		fmt.Sprintf("(%s.PUSH)\n", label) +
+		"@SP\n" +
+		"A=M\n" +
+		"M=D\n" +
+		"@SP\n" +
+		"M=M+1\n" +
+		"@R15\n" +
+		"A=M\n" +
+		"0;JMP\n"
+
+	return code
+}
+
+// writeSharedCompare writes a jump to the shared routine of the comparison command, writing the routine first if needed.
+func (c *CodeWriter) writeSharedCompare(command string) error {
+	labelIndex, err := c.getIndex(command)
+	if err != nil {
+		return c.fail(err)
+	}
+	if err := c.writeRoutine(compareRoutine(command), compareRoutineCode(command)); err != nil {
+		return err
+	}
+	c.incrementIndex(command)
+
+	returnLabel := c.internalLabel(fmt.Sprintf("%sEND%d", strings.ToUpper(command), labelIndex))
+	return c.write(fmt.Sprintf("@%s\n", returnLabel) +
+		"D=A\n" +
+		fmt.Sprintf("@%s\n", compareRoutine(command)) +
+		"0;JMP\n" +
+		fmt.Sprintf("(%s)\n", returnLabel))
+}
+
+func binaryCommandOperator(command string) (string, error) {
 	switch command {
 	case "add":
-		return "+"
+		return "+", nil
 	case "sub":
-		return "-"
+		return "-", nil
 	case "and":
-		return "&"
+		return "&", nil
 	case "or":
-		return "|"
+		return "|", nil
 	default:
-		panic(fmt.Errorf("%s is not a valid binary command", command))
+		return "", &CommandError{command}
 	}
 }
 
-func unaryCommandOperator(command string) string {
+func unaryCommandOperator(command string) (string, error) {
 	switch command {
 	case "neg":
-		return "-"
+		return "-", nil
 	case "not":
-		return "!"
+		return "!", nil
 	default:
-		panic(fmt.Errorf("%s is not a valid unary command", command))
+		return "", &CommandError{command}
 	}
 }
 
-func (c CodeWriter) getIndex(command string) int {
+func (c CodeWriter) getIndex(command string) (int, error) {
 	switch command {
 	case "eq":
-		return c.eqIndex
+		return c.eqIndex, nil
 	case "gt":
-		return c.gtIndex
+		return c.gtIndex, nil
 	case "lt":
-		return c.ltIndex
+		return c.ltIndex, nil
 	default:
-		panic(fmt.Errorf("%s is not a valid command to get index for", command))
+		return 0, &CommandError{command}
 	}
 }
 
@@ -114,7 +374,11 @@ func (c *CodeWriter) incrementIndex(command string) {
 }
 
 // WriteArithmetic writes the assembly code that is the translation of the given arithmetic command.
-func (c *CodeWriter) WriteArithmetic(command string) {
+func (c *CodeWriter) WriteArithmetic(command string) error {
+	if c.shared && (command == "eq" || command == "gt" || command == "lt") {
+		return c.writeSharedCompare(command)
+	}
+
 	code := ""
 
 	switch command {
@@ -133,31 +397,46 @@ func (c *CodeWriter) WriteArithmetic(command string) {
 				"M=-M\n"
 		}
 
-		code += fmt.Sprintf("M=D%sM\n", binaryCommandOperator(command)) +
+		operator, err := binaryCommandOperator(command)
+		if err != nil {
+			return c.fail(err)
+		}
+
+		code += fmt.Sprintf("M=D%sM\n", operator) +
 			"@SP\n" +
 			"M=M+1\n"
 
 	case "neg", "not":
+		operator, err := unaryCommandOperator(command)
+		if err != nil {
+			return c.fail(err)
+		}
+
 		code = "@SP\n" +
 			"M=M-1\n" +
 			"A=M\n" +
-			fmt.Sprintf("M=%sM\n", unaryCommandOperator(command)) +
+			fmt.Sprintf("M=%sM\n", operator) +
 			"@SP\n" +
 			"M=M+1\n"
 
-	case "eq", "lt", "gt":
-		upperCommand := strings.ToUpper(command)
-		labelIndex := c.getIndex(command)
+	case "eq":
+		labelIndex, err := c.getIndex(command)
+		if err != nil {
+			return c.fail(err)
+		}
+		checkLabel := c.internalLabel(fmt.Sprintf("CHECKEQ%d", labelIndex))
+		isLabel := c.internalLabel(fmt.Sprintf("ISEQ%d", labelIndex))
+		endLabel := c.internalLabel(fmt.Sprintf("EQEND%d", labelIndex))
 		code =
-			fmt.Sprintf("@CHECK%s%d\n", upperCommand, labelIndex) +
+			fmt.Sprintf("@%s\n", checkLabel) +
 				"0;JMP\n" +
-				fmt.Sprintf("(IS%s%d)\n", upperCommand, labelIndex) +
+				fmt.Sprintf("(%s)\n", isLabel) +
 				"@SP\n" +
 				"A=M\n" +
 				"M=-1\n" +
-				fmt.Sprintf("@%sEND%d\n", upperCommand, labelIndex) +
+				fmt.Sprintf("@%s\n", endLabel) +
 				"0;JMP\n" +
-				fmt.Sprintf("(CHECK%s%d)\n", upperCommand, labelIndex) +
+				fmt.Sprintf("(%s)\n", checkLabel) +
 				"@SP\n" +
 				"M=M-1\n" +
 				"A=M\n" +
@@ -167,89 +446,140 @@ func (c *CodeWriter) WriteArithmetic(command string) {
 				"A=M\n" +
 				"D=D-M\n" +
 				"D=-D\n" +
-				fmt.Sprintf("@IS%s%d\n", upperCommand, labelIndex) +
-				fmt.Sprintf("D;J%s\n", upperCommand) +
+				fmt.Sprintf("@%s\n", isLabel) +
+				"D;JEQ\n" +
 				"@SP\n" +
 				"A=M\n" +
 				"M=0\n" +
-				fmt.Sprintf("(%sEND%d)\n", upperCommand, labelIndex) +
+				fmt.Sprintf("(%s)\n", endLabel) +
 				"@SP\n" +
 				"M=M+1\n"
 
 		c.incrementIndex(command)
-	}
-
-	c.writer.WriteString(code)
-}
 
-func (c CodeWriter) handlePushCommand(segment string, index int) string {
-	switch segment {
-	case "constant":
-		return fmt.Sprintf("@%d\n", index) +
-			"D=A\n" +
-			"@SP\n" +
-			"A=M\n" +
-			"M=D\n" +
-			"@SP\n" +
-			"M=M+1\n"
-
-	case "local":
-		code := "@LCL\n" +
-			"A=M\n"
-
-		for i := 0; i < index; i++ {
-			code += "A=A+1\n"
+	case "gt", "lt":
+		// x-y overflows when x and y have opposite signs, so their signs are compared first:
+		// x-y is only computed when they agree, otherwise the sign of x decides.
+		upperCommand := strings.ToUpper(command)
+		labelIndex, err := c.getIndex(command)
+		if err != nil {
+			return c.fail(err)
+		}
+		isLabel := c.internalLabel(fmt.Sprintf("IS%s%d", upperCommand, labelIndex))
+		notLabel := c.internalLabel(fmt.Sprintf("NOT%s%d", upperCommand, labelIndex))
+		checkLabel := c.internalLabel(fmt.Sprintf("CHECK%s%d", upperCommand, labelIndex))
+		endLabel := c.internalLabel(fmt.Sprintf("%sEND%d", upperCommand, labelIndex))
+		negativeLabel := c.internalLabel(fmt.Sprintf("%sNEGATIVE%d", upperCommand, labelIndex))
+		sameSignLabel := c.internalLabel(fmt.Sprintf("%sSAMESIGN%d", upperCommand, labelIndex))
+		// where to go when x is non-negative and y negative, and the other way round
+		positiveX, negativeX := isLabel, notLabel
+		if command == "lt" {
+			positiveX, negativeX = notLabel, isLabel
 		}
 
-		code += "D=M\n" +
-			"@SP\n" +
-			"A=M\n" +
-			"M=D\n" +
-			"@SP\n" +
-			"M=M+1\n"
-
-		return code
-
-	case "argument":
-		code := "@ARG\n" +
-			"A=M\n"
+		code =
+			fmt.Sprintf("@%s\n", checkLabel) +
+				"0;JMP\n" +
+				fmt.Sprintf("(%s)\n", isLabel) +
+				"@SP\n" +
+				"A=M\n" +
+				"M=-1\n" +
+				fmt.Sprintf("@%s\n", endLabel) +
+				"0;JMP\n" +
+				fmt.Sprintf("(%s)\n", checkLabel) +
+				// R13 = y
+				"@SP\n" +
+				"M=M-1\n" +
+				"A=M\n" +
+				"D=M\n" +
+				"@R13\n" +
+				"M=D\n" +
+				// D = x
+				"@SP\n" +
+				"M=M-1\n" +
+				"A=M\n" +
+				"D=M\n" +
+				fmt.Sprintf("@%s\n", negativeLabel) +
+				"D;JLT\n" +
+				// x >= 0
+				"@R13\n" +
+				"D=M\n" +
+				fmt.Sprintf("@%s\n", positiveX) +
+				"D;JLT\n" +
+				fmt.Sprintf("@%s\n", sameSignLabel) +
+				"0;JMP\n" +
+				// x < 0
+				fmt.Sprintf("(%s)\n", negativeLabel) +
+				"@R13\n" +
+				"D=M\n" +
+				fmt.Sprintf("@%s\n", negativeX) +
+				"D;JGE\n" +
+				// x-y cannot overflow
+				fmt.Sprintf("(%s)\n", sameSignLabel) +
+				"@R13\n" +
+				"D=M\n" +
+				"@SP\n" +
+				"A=M\n" +
+				"D=M-D\n" +
+				fmt.Sprintf("@%s\n", isLabel) +
+				fmt.Sprintf("D;J%s\n", upperCommand) +
+				fmt.Sprintf("(%s)\n", notLabel) +
+				"@SP\n" +
+				"A=M\n" +
+				"M=0\n" +
+				fmt.Sprintf("(%s)\n", endLabel) +
+				"@SP\n" +
+				"M=M+1\n"
 
-		for i := 0; i < index; i++ {
-			code += "A=A+1\n"
-		}
+		c.incrementIndex(command)
 
-		code += "D=M\n" +
-			"@SP\n" +
-			"A=M\n" +
-			"M=D\n" +
-			"@SP\n" +
-			"M=M+1\n"
+	default:
+		return c.fail(&CommandError{command})
+	}
 
-		return code
+	return c.write(code)
+}
 
-	case "this":
-		code := "@THIS\n" +
-			"A=M\n"
+// segmentRegisters maps the segments whose base address is held in a register to that register.
+var segmentRegisters = map[string]string{
+	"local":    "LCL",
+	"argument": "ARG",
+	"this":     "THIS",
+	"that":     "THAT",
+}
 
-		for i := 0; i < index; i++ {
-			code += "A=A+1\n"
-		}
+// The address of an entry of a segment held in a register is reached by incrementing A from the base address
+// up to these indices, and computed above them. For push, @LCL A=M and i times A=A+1 take 2+i instructions
+// against 4 for @index D=A @LCL A=D+M. For pop, whose value must be moved into D first, the whole pop takes 7+i
+// instructions against 13 when the address is computed and kept in R13. Ties are broken by incrementing,
+// which leaves R13 alone.
+const (
+	maxIncrementPushIndex = 2
+	maxIncrementPopIndex  = 6
+)
 
-		code += "D=M\n" +
+func (c CodeWriter) handlePushCommand(segment string, index int) (string, error) {
+	switch segment {
+	case "constant":
+		return fmt.Sprintf("@%d\n", index) +
+			"D=A\n" +
 			"@SP\n" +
 			"A=M\n" +
 			"M=D\n" +
 			"@SP\n" +
-			"M=M+1\n"
-
-		return code
+			"M=M+1\n", nil
 
-	case "that":
-		code := "@THAT\n" +
-			"A=M\n"
-
-		for i := 0; i < index; i++ {
-			code += "A=A+1\n"
+	case "local", "argument", "this", "that":
+		var code string
+		if index <= maxIncrementPushIndex {
+			code = fmt.Sprintf("@%s\n", segmentRegisters[segment]) +
+				"A=M\n" +
+				strings.Repeat("A=A+1\n", index)
+		} else {
+			code = fmt.Sprintf("@%d\n", index) +
+				"D=A\n" +
+				fmt.Sprintf("@%s\n", segmentRegisters[segment]) +
+				"A=D+M\n"
 		}
 
 		code += "D=M\n" +
@@ -259,7 +589,7 @@ func (c CodeWriter) handlePushCommand(segment string, index int) string {
 			"@SP\n" +
 			"M=M+1\n"
 
-		return code
+		return code, nil
 
 	case "temp":
 		code := "@R5\n"
@@ -275,7 +605,7 @@ func (c CodeWriter) handlePushCommand(segment string, index int) string {
 			"@SP\n" +
 			"M=M+1\n"
 
-		return code
+		return code, nil
 
 	case "pointer":
 		var code string
@@ -293,7 +623,7 @@ func (c CodeWriter) handlePushCommand(segment string, index int) string {
 			"@SP\n" +
 			"M=M+1\n"
 
-		return code
+		return code, nil
 
 	case "static":
 		return fmt.Sprintf("@%s.%d\n", c.namespace, index) +
@@ -302,77 +632,41 @@ func (c CodeWriter) handlePushCommand(segment string, index int) string {
 			"A=M\n" +
 			"M=D\n" +
 			"@SP\n" +
-			"M=M+1\n"
+			"M=M+1\n", nil
 
 	default:
-		return ""
+		return "", &SegmentError{parser.PushCommand, segment, index}
 	}
 }
 
-func (c CodeWriter) handlePopCommand(segment string, index int) string {
+func (c CodeWriter) handlePopCommand(segment string, index int) (string, error) {
 	switch segment {
-	case "local":
-		code := "@SP\n" +
-			"M=M-1\n" +
-			"A=M\n" +
-			"D=M\n" +
-			"@LCL\n" +
-			"A=M\n"
-
-		for i := 0; i < index; i++ {
-			code += "A=A+1\n"
-		}
-
-		code += "M=D\n"
-
-		return code
-	case "argument":
-		code := "@SP\n" +
-			"M=M-1\n" +
-			"A=M\n" +
-			"D=M\n" +
-			"@ARG\n" +
-			"A=M\n"
-
-		for i := 0; i < index; i++ {
-			code += "A=A+1\n"
+	case "local", "argument", "this", "that":
+		if index <= maxIncrementPopIndex {
+			return "@SP\n" +
+				"M=M-1\n" +
+				"A=M\n" +
+				"D=M\n" +
+				fmt.Sprintf("@%s\n", segmentRegisters[segment]) +
+				"A=M\n" +
+				strings.Repeat("A=A+1\n", index) +
+				"M=D\n", nil
 		}
 
-		code += "M=D\n"
-
-		return code
-
-	case "this":
-		code := "@SP\n" +
+		// R13 = address
+		return fmt.Sprintf("@%d\n", index) +
+			"D=A\n" +
+			fmt.Sprintf("@%s\n", segmentRegisters[segment]) +
+			"D=D+M\n" +
+			"@R13\n" +
+			"M=D\n" +
+			"@SP\n" +
 			"M=M-1\n" +
 			"A=M\n" +
 			"D=M\n" +
-			"@THIS\n" +
-			"A=M\n"
-
-		for i := 0; i < index; i++ {
-			code += "A=A+1\n"
-		}
-
-		code += "M=D\n"
-
-		return code
-
-	case "that":
-		code := "@SP\n" +
-			"M=M-1\n" +
+			"@R13\n" +
 			"A=M\n" +
-			"D=M\n" +
-			"@THAT\n" +
-			"A=M\n"
-
-		for i := 0; i < index; i++ {
-			code += "A=A+1\n"
-		}
-
-		code += "M=D\n"
-
-		return code
+			"M=D\n", nil
 
 	case "temp":
 		code := "@SP\n" +
@@ -387,7 +681,7 @@ func (c CodeWriter) handlePopCommand(segment string, index int) string {
 
 		code += "M=D\n"
 
-		return code
+		return code, nil
 
 	case "pointer":
 		code := "@SP\n" +
@@ -403,7 +697,7 @@ func (c CodeWriter) handlePopCommand(segment string, index int) string {
 
 		code += "M=D\n"
 
-		return code
+		return code, nil
 
 	case "static":
 		return "@SP\n" +
@@ -411,107 +705,190 @@ func (c CodeWriter) handlePopCommand(segment string, index int) string {
 			"A=M\n" +
 			"D=M\n" +
 			fmt.Sprintf("@%s.%d\n", c.namespace, index) +
-			"M=D\n"
+			"M=D\n", nil
 
 	default:
-		return ""
+		return "", &SegmentError{parser.PopCommand, segment, index}
+	}
+}
+
+// validIndex reports whether index is within the bounds of segment.
+func validIndex(segment string, index int) bool {
+	switch segment {
+	case "constant":
+		return 0 <= index && index <= parser.MaxConstant
+	case "temp":
+		return 0 <= index && index < parser.TempSize
+	case "pointer":
+		return 0 <= index && index < parser.PointerSize
+	default:
+		return 0 <= index
 	}
 }
 
 // WritePushPop writes the assembly code that is the translation of the given command,
 // where command is either PushCommand or PopCommand.
-func (c *CodeWriter) WritePushPop(command parser.CommandTypes, segment string, index int) {
+func (c *CodeWriter) WritePushPop(command parser.CommandTypes, segment string, index int) error {
 	var code string
+	var err error
+
+	if !validIndex(segment, index) {
+		return c.fail(&SegmentError{command, segment, index})
+	}
 
 	switch command {
 	case parser.PushCommand:
-		code = c.handlePushCommand(segment, index)
+		code, err = c.handlePushCommand(segment, index)
 	case parser.PopCommand:
-		code = c.handlePopCommand(segment, index)
+		code, err = c.handlePopCommand(segment, index)
 	default:
-		panic(errors.New("codewriter.WritePushPop only accepts PushCommand and PopCommand"))
+		err = &CommandError{command.String()}
 	}
+	if err != nil {
+		return c.fail(err)
+	}
+
+	return c.write(code)
+}
 
-	c.writer.WriteString(code)
+// The symbols of the translation are mangled so that none can clash with another:
+//
+//	Main.main                     a function, named as in the VM code
+//	Main.3                        static variable 3 of the file Main.vm
+//	Main.main$LOOP                label LOOP of the function Main.main
+//	Main$$LOOP                    label LOOP of the code of Main.vm outside of functions
+//	$Main$Foo.bar.return.0        a label of the translation itself, here a return address, in the code of Main.vm
+//	$$bootstrap$Sys.init.return.0 the return address of the call to the entry point by the bootstrap code
+//	$$CALL                        a routine shared by the whole program
+//
+// VM identifiers cannot hold a dollar sign, so the symbols beginning with one are reserved to the translation.
+// Their namespace keeps apart the translations of different files, even by separate code writers.
+// The bootstrap code and the shared routines belong to the whole program instead: a program has a single
+// bootstrap, and the files of a program using shared routines must be translated by the same code writer.
+// Function names clashing with the predefined symbols or static variables are reported by linker.CheckSymbols.
+
+// internalLabel returns the symbol of a label of the translation itself: $namespace$name.
+func (c *CodeWriter) internalLabel(name string) string {
+	return fmt.Sprintf("$%s$%s", c.namespace, name)
+}
+
+// labelName returns the symbol of label: function$label within a function,
+// and namespace$$label outside of functions.
+func (c *CodeWriter) labelName(label string) string {
+	if c.functionName == "" {
+		return fmt.Sprintf("%s$$%s", c.namespace, label)
+	}
+	return fmt.Sprintf("%s$%s", c.functionName, label)
 }
 
 // WriteLabel writes assembly code that effects the label command.
-func (c *CodeWriter) WriteLabel(label string) {
-	code := fmt.Sprintf("(%s$%s)\n", c.functionName, label)
+func (c *CodeWriter) WriteLabel(label string) error {
+	code := fmt.Sprintf("(%s)\n", c.labelName(label))
 
-	c.writer.WriteString(code)
+	return c.write(code)
 }
 
 // WriteGoto writes assembly code that effects the goto command.
-func (c *CodeWriter) WriteGoto(label string) {
-	code := fmt.Sprintf("@%s$%s\n", c.functionName, label) +
+func (c *CodeWriter) WriteGoto(label string) error {
+	code := fmt.Sprintf("@%s\n", c.labelName(label)) +
 		"0;JMP\n"
 
-	c.writer.WriteString(code)
+	return c.write(code)
 }
 
 // WriteIf writes assembly code that effects the if-goto command.
-func (c *CodeWriter) WriteIf(label string) {
+func (c *CodeWriter) WriteIf(label string) error {
 	code := "@SP\n" +
 		"M=M-1\n" +
 		"A=M\n" +
 		"D=M\n" +
-		fmt.Sprintf("@%s$%s\n", c.functionName, label) +
+		fmt.Sprintf("@%s\n", c.labelName(label)) +
 		"D;JNE\n"
 
-	c.writer.WriteString(code)
+	return c.write(code)
 }
 
-// WriteCall writes assembly code that effects the call command.
-func (c *CodeWriter) WriteCall(functionName string, numArgs int) {
-	returnAddressLabel := fmt.Sprintf("%s.return.%d", functionName, c.callIndices[functionName])
-	c.callIndices[functionName]++
-
-	// push return-address
-	code := fmt.Sprintf("@%s\n", returnAddressLabel) +
-		"D=A\n" +
-		"@SP\n" +
-		"A=M\n" +
-		"M=D\n" +
-		"@SP\n" +
-		"M=M+1\n"
-
-	// push LCL
-	code += "@LCL\n" +
+// pushRegister returns code which pushes the value of register.
+func pushRegister(register string) string {
+	return fmt.Sprintf("@%s\n", register) +
 		"D=M\n" +
 		"@SP\n" +
 		"A=M\n" +
 		"M=D\n" +
 		"@SP\n" +
 		"M=M+1\n"
+}
 
-	// push ARG
-	code += "@ARG\n" +
-		"D=M\n" +
-		"@SP\n" +
-		"A=M\n" +
-		"M=D\n" +
-		"@SP\n" +
-		"M=M+1\n"
+// callRoutineCode is the code of the shared call routine, which expects the return address in D,
+// the number of arguments in R13 and the address of the function in R14.
+var callRoutineCode = "" +
+	// push return-address
+	"@SP\n" +
+	"A=M\n" +
+	"M=D\n" +
+	"@SP\n" +
+	"M=M+1\n" +
+	pushRegister("LCL") +
+	pushRegister("ARG") +
+	pushRegister("THIS") +
+	pushRegister("THAT") +
+	// ARG = SP-n-5
+	"@R13\n" +
+	"D=M\n" +
+	"@5\n" +
+	"D=D+A\n" +
+	"@SP\n" +
+	"D=M-D\n" +
+	"@ARG\n" +
+	"M=D\n" +
+	// LCL = SP
+	"@SP\n" +
+	"D=M\n" +
+	"@LCL\n" +
+	"M=D\n" +
+	// goto f
+	"@R14\n" +
+	"A=M\n" +
+	"0;JMP\n"
 
-	// push THIS
-	code += "@THIS\n" +
-		"D=M\n" +
-		"@SP\n" +
-		"A=M\n" +
-		"M=D\n" +
-		"@SP\n" +
-		"M=M+1\n"
+// WriteCall writes assembly code that effects the call command.
+func (c *CodeWriter) WriteCall(functionName string, numArgs int) error {
+	returnAddressLabel := c.internalLabel(fmt.Sprintf("%s.return.%d", functionName, c.callIndices[functionName]))
+	c.callIndices[functionName]++
 
-	// push THAT
-	code += "@THAT\n" +
-		"D=M\n" +
+	if c.shared {
+		if err := c.writeRoutine(callRoutine, callRoutineCode); err != nil {
+			return err
+		}
+		return c.write(fmt.Sprintf("@%d\n", numArgs) +
+			"D=A\n" +
+			"@R13\n" +
+			"M=D\n" +
+			fmt.Sprintf("@%s\n", functionName) +
+			"D=A\n" +
+			"@R14\n" +
+			"M=D\n" +
+			fmt.Sprintf("@%s\n", returnAddressLabel) +
+			"D=A\n" +
+			fmt.Sprintf("@%s\n", callRoutine) +
+			"0;JMP\n" +
+			fmt.Sprintf("(%s)\n", returnAddressLabel))
+	}
+
+	// push return-address
+	code := fmt.Sprintf("@%s\n", returnAddressLabel) +
+		"D=A\n" +
 		"@SP\n" +
 		"A=M\n" +
 		"M=D\n" +
 		"@SP\n" +
 		"M=M+1\n"
 
+	code += pushRegister("LCL") +
+		pushRegister("ARG") +
+		pushRegister("THIS") +
+		pushRegister("THAT")
+
 	// ARG = SP-n-5
 	code += fmt.Sprintf("@%d\n", numArgs+5) +
 		"D=A\n" +
@@ -533,84 +910,86 @@ func (c *CodeWriter) WriteCall(functionName string, numArgs int) {
 	// (return-address)
 	code += fmt.Sprintf("(%s)\n", returnAddressLabel)
 
-	c.writer.WriteString(code)
+	return c.write(code)
 }
 
-// WriteReturn writes assembly code that effects the return command.
-func (c *CodeWriter) WriteReturn() {
+// returnCode is the translation of the return command, which the shared return routine is made of as well.
+var returnCode = "" +
 	// FRAME = LCL
-	code := "@LCL\n" +
-		"D=M\n" +
-		"@R13\n" +
-		"M=D\n" +
-		"D=M\n"
-
+	"@LCL\n" +
+	"D=M\n" +
+	"@R13\n" +
+	"M=D\n" +
+	"D=M\n" +
 	// RET = *(FRAME-5)
-	code += "@5\n" +
-		"A=D-A\n" +
-		"D=M\n" +
-		"@R14\n" +
-		"M=D\n"
-
+	"@5\n" +
+	"A=D-A\n" +
+	"D=M\n" +
+	"@R14\n" +
+	"M=D\n" +
 	// *ARG = pop()
-	code += "@SP\n" +
-		"M=M-1\n" +
-		"A=M\n" +
-		"D=M\n" +
-		"@ARG\n" +
-		"A=M\n" +
-		"M=D\n"
-
+	"@SP\n" +
+	"M=M-1\n" +
+	"A=M\n" +
+	"D=M\n" +
+	"@ARG\n" +
+	"A=M\n" +
+	"M=D\n" +
 	// SP = ARG+1
-	code += "@ARG\n" +
-		"D=M+1\n" +
-		"@SP\n" +
-		"M=D\n"
-
+	"@ARG\n" +
+	"D=M+1\n" +
+	"@SP\n" +
+	"M=D\n" +
 	// THAT = *(FRAME-1)
-	code += "@R13\n" +
-		"A=M-1\n" +
-		"D=M\n" +
-		"@THAT\n" +
-		"M=D\n"
-
+	"@R13\n" +
+	"A=M-1\n" +
+	"D=M\n" +
+	"@THAT\n" +
+	"M=D\n" +
 	// THIS = *(FRAME-2)
-	code += "@2\n" +
-		"D=A\n" +
-		"@R13\n" +
-		"A=M-D\n" +
-		"D=M\n" +
-		"@THIS\n" +
-		"M=D\n"
-
+	"@2\n" +
+	"D=A\n" +
+	"@R13\n" +
+	"A=M-D\n" +
+	"D=M\n" +
+	"@THIS\n" +
+	"M=D\n" +
 	// ARG = *(FRAME-3)
-	code += "@3\n" +
-		"D=A\n" +
-		"@R13\n" +
-		"A=M-D\n" +
-		"D=M\n" +
-		"@ARG\n" +
-		"M=D\n"
-
+	"@3\n" +
+	"D=A\n" +
+	"@R13\n" +
+	"A=M-D\n" +
+	"D=M\n" +
+	"@ARG\n" +
+	"M=D\n" +
 	// LCL = *(FRAME-4)
-	code += "@4\n" +
-		"D=A\n" +
-		"@R13\n" +
-		"A=M-D\n" +
-		"D=M\n" +
-		"@LCL\n" +
-		"M=D\n"
-
+	"@4\n" +
+	"D=A\n" +
+	"@R13\n" +
+	"A=M-D\n" +
+	"D=M\n" +
+	"@LCL\n" +
+	"M=D\n" +
 	// goto RET
-	code += "@R14\n" +
-		"A=M\n" +
-		"0;JMP\n"
+	"@R14\n" +
+	"A=M\n" +
+	"0;JMP\n"
 
-	c.writer.WriteString(code)
+// WriteReturn writes assembly code that effects the return command.
+func (c *CodeWriter) WriteReturn() error {
+	if c.shared {
+		if err := c.writeRoutine(returnRoutine, returnCode); err != nil {
+			return err
+		}
+		return c.write(fmt.Sprintf("@%s\n", returnRoutine) +
+			"0;JMP\n")
+	}
+
+	return c.write(returnCode)
 }
 
 // WriteFunction writes assembly code that effects the function command.
-func (c *CodeWriter) WriteFunction(functionName string, numLocals int) {
+func (c *CodeWriter) WriteFunction(functionName string, numLocals int) error {
 	c.SetFunctionName(functionName)
 
 	code := fmt.Sprintf("(%s)\n", c.functionName)
@@ -623,15 +1002,74 @@ func (c *CodeWriter) WriteFunction(functionName string, numLocals int) {
 			"M=M+1\n"
 	}
 
-	c.writer.WriteString(code)
+	return c.write(code)
+}
+
+// WriteCommand writes the assembly code that is the translation of the given command.
+// A returned error is a *parser.Error holding the position of the command.
+func (c *CodeWriter) WriteCommand(command parser.Command) error {
+	var err error
+
+	switch command.Type {
+	case parser.ArithmeticCommand:
+		err = c.WriteArithmetic(command.Name)
+	case parser.PushCommand, parser.PopCommand:
+		err = c.WritePushPop(command.Type, command.Segment.String(), command.Index)
+	case parser.LabelCommand:
+		err = c.WriteLabel(command.Name)
+	case parser.GotoCommand:
+		err = c.WriteGoto(command.Name)
+	case parser.IfCommand:
+		err = c.WriteIf(command.Name)
+	case parser.FunctionCommand:
+		err = c.WriteFunction(command.Name, command.Index)
+	case parser.CallCommand:
+		err = c.WriteCall(command.Name, command.Index)
+	case parser.ReturnCommand:
+		err = c.WriteReturn()
+	default:
+		err = c.fail(&CommandError{command.String()})
+	}
+
+	if err != nil {
+		return &parser.Error{Pos: command.Pos, Err: err}
+	}
+	return nil
+}
+
+// Flush writes any buffered translation to the underlying writer.
+func (c *CodeWriter) Flush() error {
+	if c.err != nil {
+		return c.err
+	}
+	if len(c.instructions) != 0 {
+		for _, i := range Peephole(c.instructions) {
+			if _, c.err = fmt.Fprintln(c.writer, i.String()); c.err != nil {
+				return c.err
+			}
+		}
+		c.instructions = nil
+	}
+	c.err = c.writer.Flush()
+	return c.err
 }
 
 // Save writes the output to file.
-func (c *CodeWriter) Save() {
+// Nothing is written if an error has occurred during the translation.
+// For a code writer created by NewWriter, Save only flushes the output.
+func (c *CodeWriter) Save() error {
+	if err := c.Flush(); err != nil || c.buffer == nil {
+		return err
+	}
+
 	f, err := os.Create(c.filename)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	f.Write(c.writer.Bytes())
+	if _, err := f.Write(c.buffer.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
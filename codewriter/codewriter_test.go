@@ -1,13 +1,26 @@
 package codewriter
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/sato11/the-hack-vm-translator/emulator"
 	"github.com/sato11/the-hack-vm-translator/parser"
 )
 
+// output flushes c and returns everything it has written so far.
+func output(c *CodeWriter) string {
+	c.Flush()
+	return c.buffer.String()
+}
+
 func TestSetFileName(t *testing.T) {
 	filenames := []string{
 		"filename.asm",
@@ -49,16 +62,17 @@ func TestWriteArithmetic(t *testing.T) {
 		{"or", "@SP\nM=M-1\nA=M\nD=M\n@SP\nM=M-1\nA=M\nM=D|M\n@SP\nM=M+1\n"},
 		{"neg", "@SP\nM=M-1\nA=M\nM=-M\n@SP\nM=M+1\n"},
 		{"not", "@SP\nM=M-1\nA=M\nM=!M\n@SP\nM=M+1\n"},
-		{"eq", "@CHECKEQ0\n0;JMP\n(ISEQ0)\n@SP\nA=M\nM=-1\n@EQEND0\n0;JMP\n(CHECKEQ0)\n@SP\nM=M-1\nA=M\nD=M\n@SP\nM=M-1\nA=M\nD=D-M\nD=-D\n@ISEQ0\nD;JEQ\n@SP\nA=M\nM=0\n(EQEND0)\n@SP\nM=M+1\n"},
-		{"gt", "@CHECKGT0\n0;JMP\n(ISGT0)\n@SP\nA=M\nM=-1\n@GTEND0\n0;JMP\n(CHECKGT0)\n@SP\nM=M-1\nA=M\nD=M\n@SP\nM=M-1\nA=M\nD=D-M\nD=-D\n@ISGT0\nD;JGT\n@SP\nA=M\nM=0\n(GTEND0)\n@SP\nM=M+1\n"},
-		{"lt", "@CHECKLT0\n0;JMP\n(ISLT0)\n@SP\nA=M\nM=-1\n@LTEND0\n0;JMP\n(CHECKLT0)\n@SP\nM=M-1\nA=M\nD=M\n@SP\nM=M-1\nA=M\nD=D-M\nD=-D\n@ISLT0\nD;JLT\n@SP\nA=M\nM=0\n(LTEND0)\n@SP\nM=M+1\n"},
+		{"eq", "@$Main$CHECKEQ0\n0;JMP\n($Main$ISEQ0)\n@SP\nA=M\nM=-1\n@$Main$EQEND0\n0;JMP\n($Main$CHECKEQ0)\n@SP\nM=M-1\nA=M\nD=M\n@SP\nM=M-1\nA=M\nD=D-M\nD=-D\n@$Main$ISEQ0\nD;JEQ\n@SP\nA=M\nM=0\n($Main$EQEND0)\n@SP\nM=M+1\n"},
+		{"gt", "@$Main$CHECKGT0\n0;JMP\n($Main$ISGT0)\n@SP\nA=M\nM=-1\n@$Main$GTEND0\n0;JMP\n($Main$CHECKGT0)\n@SP\nM=M-1\nA=M\nD=M\n@R13\nM=D\n@SP\nM=M-1\nA=M\nD=M\n@$Main$GTNEGATIVE0\nD;JLT\n@R13\nD=M\n@$Main$ISGT0\nD;JLT\n@$Main$GTSAMESIGN0\n0;JMP\n($Main$GTNEGATIVE0)\n@R13\nD=M\n@$Main$NOTGT0\nD;JGE\n($Main$GTSAMESIGN0)\n@R13\nD=M\n@SP\nA=M\nD=M-D\n@$Main$ISGT0\nD;JGT\n($Main$NOTGT0)\n@SP\nA=M\nM=0\n($Main$GTEND0)\n@SP\nM=M+1\n"},
+		{"lt", "@$Main$CHECKLT0\n0;JMP\n($Main$ISLT0)\n@SP\nA=M\nM=-1\n@$Main$LTEND0\n0;JMP\n($Main$CHECKLT0)\n@SP\nM=M-1\nA=M\nD=M\n@R13\nM=D\n@SP\nM=M-1\nA=M\nD=M\n@$Main$LTNEGATIVE0\nD;JLT\n@R13\nD=M\n@$Main$NOTLT0\nD;JLT\n@$Main$LTSAMESIGN0\n0;JMP\n($Main$LTNEGATIVE0)\n@R13\nD=M\n@$Main$ISLT0\nD;JGE\n($Main$LTSAMESIGN0)\n@R13\nD=M\n@SP\nA=M\nD=M-D\n@$Main$ISLT0\nD;JLT\n($Main$NOTLT0)\n@SP\nA=M\nM=0\n($Main$LTEND0)\n@SP\nM=M+1\n"},
 	}
 
 	for i, test := range tests {
 		c := New()
+		c.SetNamespace("Main")
 		c.WriteArithmetic(test.command)
-		if c.writer.String() != test.out {
-			t.Errorf("#%d: got: %v wanted: %v", i, c.writer.String(), test.out)
+		if output(c) != test.out {
+			t.Errorf("#%d: got: %v wanted: %v", i, output(c), test.out)
 		}
 	}
 }
@@ -77,6 +91,9 @@ func TestWritePushPop(t *testing.T) {
 		{parser.PushCommand, "argument", 1, "@ARG\nA=M\nA=A+1\nD=M\n@SP\nA=M\nM=D\n@SP\nM=M+1\n"},
 		{parser.PushCommand, "this", 1, "@THIS\nA=M\nA=A+1\nD=M\n@SP\nA=M\nM=D\n@SP\nM=M+1\n"},
 		{parser.PushCommand, "that", 1, "@THAT\nA=M\nA=A+1\nD=M\n@SP\nA=M\nM=D\n@SP\nM=M+1\n"},
+		{parser.PushCommand, "local", 2, "@LCL\nA=M\nA=A+1\nA=A+1\nD=M\n@SP\nA=M\nM=D\n@SP\nM=M+1\n"},
+		{parser.PushCommand, "local", 3, "@3\nD=A\n@LCL\nA=D+M\nD=M\n@SP\nA=M\nM=D\n@SP\nM=M+1\n"},
+		{parser.PushCommand, "that", 200, "@200\nD=A\n@THAT\nA=D+M\nD=M\n@SP\nA=M\nM=D\n@SP\nM=M+1\n"},
 		{parser.PushCommand, "temp", 1, "@R5\nA=A+1\nD=M\n@SP\nA=M\nM=D\n@SP\nM=M+1\n"},
 		{parser.PushCommand, "pointer", 0, "@THIS\nD=M\n@SP\nA=M\nM=D\n@SP\nM=M+1\n"},
 		{parser.PushCommand, "pointer", 1, "@THAT\nD=M\n@SP\nA=M\nM=D\n@SP\nM=M+1\n"},
@@ -85,6 +102,10 @@ func TestWritePushPop(t *testing.T) {
 		{parser.PopCommand, "argument", 1, "@SP\nM=M-1\nA=M\nD=M\n@ARG\nA=M\nA=A+1\nM=D\n"},
 		{parser.PopCommand, "this", 1, "@SP\nM=M-1\nA=M\nD=M\n@THIS\nA=M\nA=A+1\nM=D\n"},
 		{parser.PopCommand, "that", 1, "@SP\nM=M-1\nA=M\nD=M\n@THAT\nA=M\nA=A+1\nM=D\n"},
+		{parser.PopCommand, "argument", 5, "@SP\nM=M-1\nA=M\nD=M\n@ARG\nA=M\nA=A+1\nA=A+1\nA=A+1\nA=A+1\nA=A+1\nM=D\n"},
+		{parser.PopCommand, "argument", 6, "@SP\nM=M-1\nA=M\nD=M\n@ARG\nA=M\nA=A+1\nA=A+1\nA=A+1\nA=A+1\nA=A+1\nA=A+1\nM=D\n"},
+		{parser.PopCommand, "argument", 7, "@7\nD=A\n@ARG\nD=D+M\n@R13\nM=D\n@SP\nM=M-1\nA=M\nD=M\n@R13\nA=M\nM=D\n"},
+		{parser.PopCommand, "this", 200, "@200\nD=A\n@THIS\nD=D+M\n@R13\nM=D\n@SP\nM=M-1\nA=M\nD=M\n@R13\nA=M\nM=D\n"},
 		{parser.PopCommand, "temp", 1, "@SP\nM=M-1\nA=M\nD=M\n@R5\nA=A+1\nM=D\n"},
 		{parser.PopCommand, "pointer", 0, "@SP\nM=M-1\nA=M\nD=M\n@THIS\nM=D\n"},
 		{parser.PopCommand, "pointer", 1, "@SP\nM=M-1\nA=M\nD=M\n@THAT\nM=D\n"},
@@ -95,8 +116,8 @@ func TestWritePushPop(t *testing.T) {
 		c := New()
 		c.SetNamespace("Static")
 		c.WritePushPop(test.commandType, test.segment, test.index)
-		if c.writer.String() != test.out {
-			t.Errorf("#%d: got: %v wanted: %v", i, c.writer.String(), test.out)
+		if output(c) != test.out {
+			t.Errorf("#%d: got: %v wanted: %v", i, output(c), test.out)
 		}
 	}
 }
@@ -117,8 +138,8 @@ func TestWriteLabel(t *testing.T) {
 		c := New()
 		c.SetFunctionName(test.functionName)
 		c.WriteLabel(test.label)
-		if c.writer.String() != test.out {
-			t.Errorf("#%d: got: %v wanted: %v", i, c.writer.String(), test.out)
+		if output(c) != test.out {
+			t.Errorf("#%d: got: %v wanted: %v", i, output(c), test.out)
 		}
 	}
 }
@@ -133,8 +154,8 @@ func TestWriteGoto(t *testing.T) {
 		c := New()
 		c.SetFunctionName(test.functionName)
 		c.WriteGoto(test.label)
-		if c.writer.String() != test.out {
-			t.Errorf("#%d: got: %v wanted: %v", i, c.writer.String(), test.out)
+		if output(c) != test.out {
+			t.Errorf("#%d: got: %v wanted: %v", i, output(c), test.out)
 		}
 	}
 }
@@ -149,8 +170,8 @@ func TestWriteIf(t *testing.T) {
 		c := New()
 		c.SetFunctionName(test.functionName)
 		c.WriteIf(test.label)
-		if c.writer.String() != test.out {
-			t.Errorf("#%d: got: %v wanted: %v", i, c.writer.String(), test.out)
+		if output(c) != test.out {
+			t.Errorf("#%d: got: %v wanted: %v", i, output(c), test.out)
 		}
 	}
 }
@@ -159,7 +180,7 @@ func TestWriteReturn(t *testing.T) {
 	c := New()
 	c.WriteReturn()
 
-	actual := c.writer.String()
+	actual := output(c)
 	expected := strings.Join([]string{
 		"@LCL",
 		"D=M",
@@ -233,8 +254,685 @@ func TestWriteFunction(t *testing.T) {
 	for i, test := range tests {
 		c := New()
 		c.WriteFunction(test.functionName, test.numLocals)
-		if c.writer.String() != test.out {
-			t.Errorf("#%d: got: %v wanted: %v", i, c.writer.String(), test.out)
+		if output(c) != test.out {
+			t.Errorf("#%d: got: %v wanted: %v", i, output(c), test.out)
+		}
+	}
+}
+
+func TestWriteCommand(t *testing.T) {
+	commands := []string{
+		"push constant 7",
+		"push static 2",
+		"pop local 3",
+		"eq",
+		"label LOOP",
+		"goto LOOP",
+		"if-goto LOOP",
+		"function Main.main 2",
+		"call Math.multiply 2",
+		"return",
+	}
+
+	p := parser.New(strings.NewReader(strings.Join(commands, "\n")))
+	actual := New()
+	actual.SetNamespace("Main")
+	expected := New()
+	expected.SetNamespace("Main")
+	for p.HasMoreCommands() {
+		p.Advance()
+		command, err := p.Parse()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		actual.WriteCommand(command)
+	}
+
+	expected.WritePushPop(parser.PushCommand, "constant", 7)
+	expected.WritePushPop(parser.PushCommand, "static", 2)
+	expected.WritePushPop(parser.PopCommand, "local", 3)
+	expected.WriteArithmetic("eq")
+	expected.WriteLabel("LOOP")
+	expected.WriteGoto("LOOP")
+	expected.WriteIf("LOOP")
+	expected.WriteFunction("Main.main", 2)
+	expected.WriteCall("Math.multiply", 2)
+	expected.WriteReturn()
+
+	if output(actual) != output(expected) {
+		t.Errorf("got: %v wanted: %v", output(actual), output(expected))
+	}
+}
+
+type commandErrorTest struct {
+	write   func(c *CodeWriter) error
+	command string
+}
+
+func TestCommandError(t *testing.T) {
+	tests := []commandErrorTest{
+		{func(c *CodeWriter) error { return c.WriteArithmetic("mul") }, "mul"},
+		{func(c *CodeWriter) error { return c.WriteArithmetic("") }, ""},
+		{func(c *CodeWriter) error { return c.WritePushPop(parser.LabelCommand, "local", 0) }, "label"},
+	}
+
+	for i, test := range tests {
+		c := New()
+		err := test.write(c)
+
+		var e *CommandError
+		if !errors.As(err, &e) {
+			t.Errorf("#%d: got: %v wanted: *CommandError", i, err)
+		} else if e.Command != test.command {
+			t.Errorf("#%d: got: %v wanted: %v", i, e.Command, test.command)
+		}
+		if c.Err() != err {
+			t.Errorf("#%d: got: %v wanted: %v", i, c.Err(), err)
+		}
+		if len(output(c)) != 0 {
+			t.Errorf("#%d: got: %v wanted: empty output", i, output(c))
+		}
+	}
+}
+
+func TestSegmentError(t *testing.T) {
+	tests := []writePushPopTest{
+		{parser.PopCommand, "constant", 3, ""},
+		{parser.PushCommand, "heap", 0, ""},
+		{parser.PopCommand, "heap", 0, ""},
+		{parser.PushCommand, "pointer", 5, ""},
+		{parser.PopCommand, "temp", 9, ""},
+		{parser.PushCommand, "constant", 32768, ""},
+		{parser.PushCommand, "local", -1, ""},
+	}
+
+	for i, test := range tests {
+		c := New()
+		err := c.WritePushPop(test.commandType, test.segment, test.index)
+
+		var e *SegmentError
+		if !errors.As(err, &e) {
+			t.Errorf("#%d: got: %v wanted: *SegmentError", i, err)
+		} else if *e != (SegmentError{test.commandType, test.segment, test.index}) {
+			t.Errorf("#%d: got: %v wanted: %v", i, *e, SegmentError{test.commandType, test.segment, test.index})
+		}
+		if len(output(c)) != 0 {
+			t.Errorf("#%d: got: %v wanted: empty output", i, output(c))
+		}
+	}
+}
+
+func TestWriteCommandError(t *testing.T) {
+	c := New()
+	err := c.WriteCommand(parser.Command{
+		Type:    parser.PopCommand,
+		Segment: parser.ConstantSegment,
+		Index:   3,
+		Pos:     parser.Position{Filename: "Main.vm", Line: 12, Column: 5},
+	})
+
+	expected := "Main.vm:12:5: codewriter: cannot translate pop constant 3"
+	if err == nil || err.Error() != expected {
+		t.Errorf("got: %v wanted: %v", err, expected)
+	}
+
+	var e *SegmentError
+	if !errors.As(err, &e) {
+		t.Errorf("got: %v wanted: *SegmentError", err)
+	}
+}
+
+func TestSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codewriter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := New()
+	c.SetFileName(filepath.Join(dir, "Main.asm"))
+	c.WritePushPop(parser.PushCommand, "constant", 7)
+	if err := c.Save(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "Main.asm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != output(c) {
+		t.Errorf("got: %v wanted: %v", string(b), output(c))
+	}
+
+	c.SetFileName(filepath.Join(dir, "missing", "Main.asm"))
+	var e *os.PathError
+	if err := c.Save(); !errors.As(err, &e) {
+		t.Errorf("got: %v wanted: *os.PathError", err)
+	}
+
+	c = New()
+	c.SetFileName(filepath.Join(dir, "Invalid.asm"))
+	c.WriteArithmetic("mul")
+	if err := c.Save(); err != c.Err() {
+		t.Errorf("got: %v wanted: %v", err, c.Err())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Invalid.asm")); !os.IsNotExist(err) {
+		t.Errorf("got: %v wanted: file not to exist", err)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestNewWriter(t *testing.T) {
+	var b bytes.Buffer
+	c := NewWriter(&b)
+	c.WritePushPop(parser.PushCommand, "constant", 7)
+	c.WriteArithmetic("neg")
+	if err := c.Flush(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "@7\nD=A\n@SP\nA=M\nM=D\n@SP\nM=M+1\n@SP\nM=M-1\nA=M\nM=-M\n@SP\nM=M+1\n"
+	if b.String() != expected {
+		t.Errorf("got: %v wanted: %v", b.String(), expected)
+	}
+}
+
+func TestNewWriterStreams(t *testing.T) {
+	var b bytes.Buffer
+	c := NewWriter(&b)
+	for b.Len() == 0 {
+		if err := c.WriteCall("Main.main", 0); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if c.callIndices["Main.main"] > 1000 {
+			t.Fatalf("got: nothing written wanted: output streamed before Flush")
+		}
+	}
+}
+
+func TestNewWriterError(t *testing.T) {
+	c := NewWriter(failingWriter{})
+	for i := 0; i < 1000 && c.Err() == nil; i++ {
+		c.WriteCall("Main.main", 0)
+	}
+	if c.Err() == nil {
+		t.Fatalf("got: nil wanted: write failed")
+	}
+	if err := c.WriteReturn(); err != c.Err() {
+		t.Errorf("got: %v wanted: %v", err, c.Err())
+	}
+	if err := c.Flush(); err != c.Err() {
+		t.Errorf("got: %v wanted: %v", err, c.Err())
+	}
+}
+
+type writeProgramTest struct {
+	source    string
+	bootstrap Bootstrap
+	setup     bool
+}
+
+func TestWriteProgram(t *testing.T) {
+	withSysInit := "function Sys.init 0\nlabel WHILE\ngoto WHILE"
+	withoutSysInit := "push constant 7\npush constant 8\nadd"
+	tests := []writeProgramTest{
+		{withSysInit, BootstrapAuto, true},
+		{withoutSysInit, BootstrapAuto, false},
+		{withSysInit, BootstrapAlways, true},
+		{withoutSysInit, BootstrapAlways, true},
+		{withSysInit, BootstrapNever, false},
+		{withoutSysInit, BootstrapNever, false},
+	}
+
+	for i, test := range tests {
+		file, err := parser.ParseFile("Sys.vm", strings.NewReader(test.source))
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+
+		expected := New()
+		if test.setup {
+			expected.Setup()
+		}
+		expected.SetNamespace("Sys")
+		for _, command := range file.Commands {
+			expected.WriteCommand(command)
+		}
+
+		c := New()
+		if err := c.WriteProgram([]*parser.File{file}, test.bootstrap); err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if output(c) != output(expected) {
+			t.Errorf("#%d: got: %v wanted: %v", i, output(c), output(expected))
+		}
+	}
+}
+
+func TestWriteProgramEntry(t *testing.T) {
+	file, err := parser.ParseFile("Main.vm", strings.NewReader("function Main.main 0\nlabel END\ngoto END"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c := New()
+	c.SetEntry("Main.main")
+	if err := c.WriteProgram([]*parser.File{file}, BootstrapAuto); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(output(c), "@Main.main\n0;JMP\n") || strings.Contains(output(c), "Sys.init") {
+		t.Errorf("got: %v wanted: bootstrap code calling Main.main", output(c))
+	}
+}
+
+func TestWriteProgramLabelScopes(t *testing.T) {
+	sources := []string{
+		"A.vm", "function A.f 0\nlabel LOOP\ngoto LOOP",
+		"B.vm", "label LOOP\ngoto LOOP",
+		"C.vm", "label LOOP\ngoto LOOP",
+	}
+	var files []*parser.File
+	for i := 0; i < len(sources); i += 2 {
+		file, err := parser.ParseFile(sources[i], strings.NewReader(sources[i+1]))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		files = append(files, file)
+	}
+
+	c := New()
+	if err := c.WriteProgram(files, BootstrapNever); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, label := range []string{"(A.f$LOOP)\n", "(B$$LOOP)\n", "(C$$LOOP)\n"} {
+		if !strings.Contains(output(c), label) {
+			t.Errorf("got: %v wanted: %v", output(c), label)
+		}
+	}
+	if _, err := emulator.LoadAsm(strings.NewReader(output(c))); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestSeparateTranslations(t *testing.T) {
+	// the same commands in two files, translated by separate code writers, are concatenated into a program
+	source := "push constant 1\npush constant 2\neq\npush constant 3\ngt\ncall Sys.init 0\n"
+	translate := func(name string, shared bool) string {
+		file, err := parser.ParseFile(name, strings.NewReader(source))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		c := New()
+		c.SetSharedRoutines(shared)
+		if err := c.WriteProgram([]*parser.File{file}, BootstrapNever); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return output(c)
+	}
+	bootstrap := func() string {
+		c := New()
+		c.SetNamespace("A")
+		if err := c.Setup(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return output(c)
+	}
+
+	tests := []struct {
+		name string
+		asm  string
+		err  bool
+	}{
+		{"files", translate("A.vm", false) + translate("B.vm", false), false},
+		{"bootstrap", bootstrap() + translate("A.vm", false) + translate("B.vm", false), false},
+		// shared routines belong to the whole program, which must be translated at once
+		{"shared routines", translate("A.vm", true) + translate("B.vm", true), true},
+	}
+
+	for _, tt := range tests {
+		_, err := emulator.LoadAsm(strings.NewReader(tt.asm + "(Sys.init)\n"))
+		if (err != nil) != tt.err {
+			t.Errorf("%s: got: %v wanted an error: %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+// execute translates the VM code in source without bootstrap code, runs it on an emulator
+// whose stack pointer is set to 256, and returns the emulator once the program has halted.
+func execute(t *testing.T, source string) *emulator.Computer {
+	t.Helper()
+	return executeShared(t, source, false)
+}
+
+// executeShared is like execute, with the shared routines selected by shared.
+// The translation is run through the peephole optimizer as well, which must leave the RAM the same
+// but for R13 to R15, where the shared routines keep addresses of instructions.
+func executeShared(t *testing.T, source string, shared bool) *emulator.Computer {
+	t.Helper()
+	computer := run(t, source, shared, false)
+	optimized := run(t, source, shared, true)
+	for address := range computer.RAM {
+		if address >= 13 && address <= 15 {
+			continue
+		}
+		if computer.RAM[address] != optimized.RAM[address] {
+			t.Errorf("optimized: RAM[%d]: got: %v wanted: %v", address, optimized.RAM[address], computer.RAM[address])
+			break
+		}
+	}
+	return computer
+}
+
+// run translates source as selected by shared and optimize, and runs it.
+func run(t *testing.T, source string, shared, optimize bool) *emulator.Computer {
+	t.Helper()
+	file, err := parser.ParseFile("Test.vm", strings.NewReader(source))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c := New()
+	c.SetSharedRoutines(shared)
+	c.SetOptimize(optimize)
+	if err := c.WriteProgram([]*parser.File{file}, BootstrapNever); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	computer, err := emulator.LoadAsm(strings.NewReader(output(c)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	computer.Poke(0, 256)
+	if err := computer.RunUntilHalt(100000); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return computer
+}
+
+func TestExecuteSimpleAdd(t *testing.T) {
+	b, err := ioutil.ReadFile(filepath.Join("..", "testdata", "StackArithmetic", "SimpleAdd", "SimpleAdd.vm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	computer := execute(t, string(b))
+	if computer.Peek(0) != 257 {
+		t.Errorf("got: %v wanted: %v", computer.Peek(0), 257)
+	}
+	if computer.Peek(256) != 15 {
+		t.Errorf("got: %v wanted: %v", computer.Peek(256), 15)
+	}
+}
+
+type executeArithmeticTest struct {
+	x, y    int16
+	command string
+	out     int16
+}
+
+func TestExecuteArithmetic(t *testing.T) {
+	tests := []executeArithmeticTest{
+		{7, 8, "add", 15},
+		{7, 8, "sub", -1},
+		{12, 10, "and", 8},
+		{12, 10, "or", 14},
+		{7, 8, "eq", 0},
+		{8, 8, "eq", -1},
+		{8, 7, "gt", -1},
+		{7, 8, "gt", 0},
+		{8, 8, "gt", 0},
+		{7, 8, "lt", -1},
+		{8, 7, "lt", 0},
+		{8, 8, "lt", 0},
+		{0, 7, "neg", -7},
+		{0, 0, "not", -1},
+	}
+
+	for i, test := range tests {
+		source := fmt.Sprintf("push constant %d\npush constant %d\n%s", test.x, test.y, test.command)
+		computer := execute(t, source)
+
+		expected := int16(257)
+		if test.command == "neg" || test.command == "not" {
+			expected = 258
+		}
+		if computer.Peek(0) != expected {
+			t.Errorf("#%d: got: SP=%v wanted: SP=%v", i, computer.Peek(0), expected)
+		}
+		if computer.Peek(int(expected)-1) != test.out {
+			t.Errorf("#%d: got: %v wanted: %v", i, computer.Peek(int(expected)-1), test.out)
+		}
+	}
+}
+
+// pushValue returns VM code pushing value, which the constant segment alone cannot hold when negative.
+func pushValue(value int16) string {
+	switch {
+	case value == -32768:
+		return "push constant 32767\nneg\npush constant 1\nsub\n"
+	case value < 0:
+		return fmt.Sprintf("push constant %d\nneg\n", -value)
+	default:
+		return fmt.Sprintf("push constant %d\n", value)
+	}
+}
+
+func TestExecuteComparisonBoundaries(t *testing.T) {
+	values := []int16{-32768, -32767, -2, -1, 0, 1, 2, 32766, 32767}
+	compare := map[string]func(x, y int16) bool{
+		"eq": func(x, y int16) bool { return x == y },
+		"gt": func(x, y int16) bool { return x > y },
+		"lt": func(x, y int16) bool { return x < y },
+	}
+
+	for _, shared := range []bool{false, true} {
+		for _, x := range values {
+			for _, y := range values {
+				for command, f := range compare {
+					computer := executeShared(t, pushValue(x)+pushValue(y)+command, shared)
+
+					expected := int16(0)
+					if f(x, y) {
+						expected = -1
+					}
+					if computer.Peek(0) != 257 || computer.Peek(256) != expected {
+						t.Errorf("shared=%v: %d %s %d: got: SP=%v %v wanted: SP=257 %v", shared, x, command, y, computer.Peek(0), computer.Peek(256), expected)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestExecuteSegments(t *testing.T) {
+	source := strings.Join([]string{
+		"push constant 3030",
+		"pop pointer 0",
+		"push constant 3040",
+		"pop pointer 1",
+		"push constant 32",
+		"pop this 2",
+		"push constant 46",
+		"pop that 6",
+		"push constant 510",
+		"pop temp 6",
+		"push constant 111",
+		"pop static 3",
+		"push this 2",
+		"push that 6",
+		"add",
+		"push temp 6",
+		"add",
+		"push static 3",
+		"sub",
+	}, "\n")
+	computer := execute(t, source)
+
+	expected := map[int]int16{0: 257, 3: 3030, 4: 3040, 3032: 32, 3046: 46, 11: 510, 256: 32 + 46 + 510 - 111}
+	for address, value := range expected {
+		if computer.Peek(address) != value {
+			t.Errorf("RAM[%d]: got: %v wanted: %v", address, computer.Peek(address), value)
 		}
 	}
+	if address, ok := computer.Symbol("Test.3"); !ok || computer.Peek(address) != 111 {
+		t.Errorf("got: %v wanted: %v", computer.Peek(address), 111)
+	}
+}
+
+func TestExecuteSegmentIndices(t *testing.T) {
+	// Every index around the thresholds of the address computation, in every segment held in a register.
+	var source strings.Builder
+	source.WriteString("push constant 3000\npop pointer 0\npush constant 4000\npop pointer 1\n")
+	for _, segment := range []string{"local", "argument", "this", "that"} {
+		for index := 0; index <= 8; index++ {
+			fmt.Fprintf(&source, "push constant %d\npop %s %d\n", 100+index, segment, index)
+		}
+		fmt.Fprintf(&source, "push constant 300\npop %s 200\n", segment)
+		for _, index := range []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 200} {
+			fmt.Fprintf(&source, "push %s %d\n", segment, index)
+		}
+	}
+
+	file, err := parser.ParseFile("Test.vm", strings.NewReader(source.String()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c := New()
+	if err := c.WriteProgram([]*parser.File{file}, BootstrapNever); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	computer, err := emulator.LoadAsm(strings.NewReader(output(c)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	bases := map[string]int{"local": 1000, "argument": 2000, "this": 3000, "that": 4000}
+	computer.Poke(0, 256)
+	computer.Poke(1, 1000)
+	computer.Poke(2, 2000)
+	if err := computer.RunUntilHalt(100000); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sp := 256
+	for _, segment := range []string{"local", "argument", "this", "that"} {
+		for _, index := range []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 200} {
+			want := int16(100 + index)
+			if index == 200 {
+				want = 300
+			}
+			if got := computer.Peek(bases[segment] + index); got != want {
+				t.Errorf("%s %d: got: %v wanted: %v", segment, index, got, want)
+			}
+			if got := computer.Peek(sp); got != want {
+				t.Errorf("push %s %d: got: %v wanted: %v", segment, index, got, want)
+			}
+			sp++
+		}
+	}
+}
+
+func TestSharedRoutines(t *testing.T) {
+	c := NewWriter(ioutil.Discard)
+	c.SetSharedRoutines(true)
+	for _, command := range []string{"eq", "gt", "lt"} {
+		c.WriteArithmetic(command)
+	}
+	c.WriteCall("Main.f", 2)
+	c.WriteReturn()
+	for label := range map[string]bool{"$$EQ": true, "$$GT": true, "$$LT": true, callRoutine: true, returnRoutine: true} {
+		if !c.routines[label] {
+			t.Errorf("routine %s has not been written", label)
+		}
+	}
+
+	// Once written, routines are only jumped to.
+	var b bytes.Buffer
+	c = NewWriter(&b)
+	c.SetNamespace("Main")
+	c.SetSharedRoutines(true)
+	c.routines[compareRoutine("gt")] = true
+	c.routines[callRoutine] = true
+	c.routines[returnRoutine] = true
+	c.WriteArithmetic("gt")
+	c.WriteCall("Main.f", 2)
+	c.WriteReturn()
+	if err := c.Flush(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "@$Main$GTEND0\nD=A\n@$$GT\n0;JMP\n($Main$GTEND0)\n" +
+		"@2\nD=A\n@R13\nM=D\n@Main.f\nD=A\n@R14\nM=D\n@$Main$Main.f.return.0\nD=A\n@$$CALL\n0;JMP\n($Main$Main.f.return.0)\n" +
+		"@$$RETURN\n0;JMP\n"
+	if b.String() != expected {
+		t.Errorf("got: %v wanted: %v", b.String(), expected)
+	}
+}
+
+func TestExecuteSharedRoutines(t *testing.T) {
+	source := `push constant 3
+push constant 4
+call Main.add 2
+push constant 5
+gt
+push constant 6
+push constant 6
+eq
+push constant 32767
+neg
+push constant 2
+lt
+label END
+goto END
+function Main.add 1
+push argument 0
+push argument 1
+add
+pop local 0
+push local 0
+push local 0
+gt
+not
+push local 0
+add
+return
+`
+	inline := execute(t, source)
+	shared := executeShared(t, source, true)
+	for address, want := range map[int]int16{0: 259, 256: -1, 257: -1, 258: -1} {
+		if got := shared.Peek(address); got != want {
+			t.Errorf("RAM[%d]: got: %v wanted: %v", address, got, want)
+		}
+		if got := inline.Peek(address); got != want {
+			t.Errorf("inline: RAM[%d]: got: %v wanted: %v", address, got, want)
+		}
+	}
+}
+
+func TestSharedRoutinesSize(t *testing.T) {
+	var source strings.Builder
+	source.WriteString("function Main.main 0\n")
+	for i := 0; i < 20; i++ {
+		source.WriteString("push constant 1\npush constant 2\nlt\ncall Main.main 0\n")
+	}
+	source.WriteString("return\n")
+
+	var sizes [2]int
+	for i, shared := range []bool{false, true} {
+		file, err := parser.ParseFile("Main.vm", strings.NewReader(source.String()))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		c := New()
+		c.SetSharedRoutines(shared)
+		if err := c.WriteProgram([]*parser.File{file}, BootstrapNever); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		sizes[i] = strings.Count(output(c), "\n") - strings.Count(output(c), "(")
+	}
+	if sizes[1]*2 > sizes[0] {
+		t.Errorf("shared routines: got %d instructions against %d inline, wanted at most half", sizes[1], sizes[0])
+	}
 }
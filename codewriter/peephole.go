@@ -0,0 +1,189 @@
+package codewriter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Instruction is a line of Hack assembly: a label, an A-instruction or a C-instruction.
+type Instruction struct {
+	// Label is the name of a label, such as LOOP for (LOOP).
+	Label string
+	// Address is the symbol or constant of an A-instruction, such as SP for @SP.
+	Address string
+	// Dest, Comp and Jump are the fields of a C-instruction, such as M, M+1 and "" for M=M+1.
+	Dest, Comp, Jump string
+}
+
+// IsLabel reports whether i is a label.
+func (i Instruction) IsLabel() bool {
+	return i.Label != ""
+}
+
+// IsAddress reports whether i is an A-instruction.
+func (i Instruction) IsAddress() bool {
+	return i.Address != ""
+}
+
+// String returns the instruction as a line of Hack assembly.
+func (i Instruction) String() string {
+	switch {
+	case i.IsLabel():
+		return fmt.Sprintf("(%s)", i.Label)
+	case i.IsAddress():
+		return "@" + i.Address
+	}
+
+	s := i.Comp
+	if i.Dest != "" {
+		s = i.Dest + "=" + s
+	}
+	if i.Jump != "" {
+		s += ";" + i.Jump
+	}
+	return s
+}
+
+// setsA reports whether i may change the A register.
+func (i Instruction) setsA() bool {
+	return i.IsAddress() || strings.Contains(i.Dest, "A")
+}
+
+// ParseAssembly splits the Hack assembly code written by a code writer into instructions.
+// Blank lines are skipped; comments are not expected.
+func ParseAssembly(code string) []Instruction {
+	var instructions []Instruction
+	for _, line := range strings.Split(code, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "("):
+			instructions = append(instructions, Instruction{Label: strings.Trim(line, "()")})
+		case strings.HasPrefix(line, "@"):
+			instructions = append(instructions, Instruction{Address: line[1:]})
+		default:
+			var i Instruction
+			if eq := strings.Index(line, "="); eq >= 0 {
+				i.Dest, line = line[:eq], line[eq+1:]
+			}
+			if semicolon := strings.Index(line, ";"); semicolon >= 0 {
+				line, i.Jump = line[:semicolon], line[semicolon+1:]
+			}
+			i.Comp = line
+			instructions = append(instructions, i)
+		}
+	}
+	return instructions
+}
+
+// matches reports whether instructions begin with the lines of code.
+func matches(instructions []Instruction, code ...string) bool {
+	if len(instructions) < len(code) {
+		return false
+	}
+	for j, line := range code {
+		if instructions[j].String() != line {
+			return false
+		}
+	}
+	return true
+}
+
+// removePushPop removes a push immediately followed by a pop, where the value pushed is still in D
+// and the stack pointer is left as it is.
+// The store of the value on top of the stack is kept, so the memory ends up the same.
+func removePushPop(instructions []Instruction) ([]Instruction, bool) {
+	var out []Instruction
+	changed := false
+	for j := 0; j < len(instructions); j++ {
+		// @SP A=M M=D ends a push, whose value is in D and A the address it is stored at
+		if j >= 3 && matches(instructions[j-3:], "@SP", "A=M", "M=D") &&
+			matches(instructions[j:], "@SP", "M=M+1", "@SP", "M=M-1", "A=M", "D=M") {
+			j += 5
+			changed = true
+			continue
+		}
+		out = append(out, instructions[j])
+	}
+	return out, changed
+}
+
+// removeRedundantAddresses removes A-instructions loading A with the value it already holds.
+// A is unknown after a label, which may be reached from anywhere.
+func removeRedundantAddresses(instructions []Instruction) ([]Instruction, bool) {
+	var out []Instruction
+	changed := false
+	known := ""
+	for _, i := range instructions {
+		switch {
+		case i.IsLabel():
+			known = ""
+		case i.IsAddress():
+			if i.Address == known {
+				changed = true
+				continue
+			}
+			known = i.Address
+		case i.setsA():
+			known = ""
+		}
+		out = append(out, i)
+	}
+	return out, changed
+}
+
+// removeCancellingUpdates removes M=M+1 immediately followed by M=M-1, or the other way round,
+// which leave the memory as it is.
+func removeCancellingUpdates(instructions []Instruction) ([]Instruction, bool) {
+	var out []Instruction
+	changed := false
+	for j := 0; j < len(instructions); j++ {
+		if matches(instructions[j:], "M=M+1", "M=M-1") || matches(instructions[j:], "M=M-1", "M=M+1") {
+			j++
+			changed = true
+			continue
+		}
+		out = append(out, instructions[j])
+	}
+	return out, changed
+}
+
+// removeJumpsToNext removes jumps to the label right after them, leaving the label for other jumps.
+func removeJumpsToNext(instructions []Instruction) ([]Instruction, bool) {
+	var out []Instruction
+	changed := false
+	for j := 0; j < len(instructions); j++ {
+		if j+2 < len(instructions) && instructions[j].IsAddress() {
+			jump, label := instructions[j+1], instructions[j+2]
+			if jump.Jump != "" && jump.Dest == "" && label.Label == instructions[j].Address {
+				j++
+				changed = true
+				continue
+			}
+		}
+		out = append(out, instructions[j])
+	}
+	return out, changed
+}
+
+// Peephole returns instructions with local waste removed: pushes immediately followed by pops,
+// A-instructions loading the address A already holds, increments of the stack pointer undone right away
+// and jumps to the next instruction. The code behaves as before, except that it may leave different
+// values in the registers A and D and above the stack pointer.
+func Peephole(instructions []Instruction) []Instruction {
+	passes := []func([]Instruction) ([]Instruction, bool){
+		removePushPop,
+		removeRedundantAddresses,
+		removeCancellingUpdates,
+		removeJumpsToNext,
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, pass := range passes {
+			var c bool
+			instructions, c = pass(instructions)
+			changed = changed || c
+		}
+	}
+	return instructions
+}
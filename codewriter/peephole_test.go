@@ -0,0 +1,91 @@
+package codewriter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseAssembly(t *testing.T) {
+	code := "(LOOP)\n@SP\nAM=M-1\nD=M\nD;JGT\n0;JMP\n"
+	want := []Instruction{
+		{Label: "LOOP"},
+		{Address: "SP"},
+		{Dest: "AM", Comp: "M-1"},
+		{Dest: "D", Comp: "M"},
+		{Comp: "D", Jump: "JGT"},
+		{Comp: "0", Jump: "JMP"},
+	}
+	got := ParseAssembly(code)
+	if len(got) != len(want) {
+		t.Fatalf("got: %v wanted: %v", got, want)
+	}
+	var lines []string
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got: %+v wanted: %+v", got[i], want[i])
+		}
+		lines = append(lines, got[i].String())
+	}
+	if s := strings.Join(lines, "\n") + "\n"; s != code {
+		t.Errorf("got: %q wanted: %q", s, code)
+	}
+}
+
+func TestPeephole(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want string
+	}{
+		{
+			"push then pop",
+			"@7\nD=A\n@SP\nA=M\nM=D\n@SP\nM=M+1\n@SP\nM=M-1\nA=M\nD=M\n@R5\nM=D\n",
+			"@7\nD=A\n@SP\nA=M\nM=D\n@R5\nM=D\n",
+		},
+		{
+			"redundant address",
+			"@SP\nM=M+1\n@SP\nM=M+1\n",
+			"@SP\nM=M+1\nM=M+1\n",
+		},
+		{
+			"address after a label",
+			"@SP\nM=M+1\n(L)\n@SP\nM=M+1\n",
+			"@SP\nM=M+1\n(L)\n@SP\nM=M+1\n",
+		},
+		{
+			"address after A changes",
+			"@SP\nA=M\n@SP\nM=M+1\n",
+			"@SP\nA=M\n@SP\nM=M+1\n",
+		},
+		{
+			"cancelling updates",
+			"@SP\nM=M+1\nM=M-1\nD=M\n",
+			"@SP\nD=M\n",
+		},
+		{
+			"jump to next",
+			"@END\n0;JMP\n(END)\n@END\nD;JEQ\n",
+			"(END)\n@END\nD;JEQ\n",
+		},
+		{
+			"conditional jump to next",
+			"@NEXT\nD;JGT\n(NEXT)\n",
+			"(NEXT)\n",
+		},
+		{
+			"jump storing a result",
+			"@NEXT\nD=D-1;JGT\n(NEXT)\n",
+			"@NEXT\nD=D-1;JGT\n(NEXT)\n",
+		},
+	}
+
+	for _, tt := range tests {
+		var b strings.Builder
+		for _, i := range Peephole(ParseAssembly(tt.code)) {
+			b.WriteString(i.String() + "\n")
+		}
+		if b.String() != tt.want {
+			t.Errorf("%s: got: %q wanted: %q", tt.name, b.String(), tt.want)
+		}
+	}
+}
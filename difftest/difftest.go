@@ -0,0 +1,217 @@
+package difftest
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sato11/the-hack-vm-translator/assembler"
+	"github.com/sato11/the-hack-vm-translator/codewriter"
+	"github.com/sato11/the-hack-vm-translator/emulator"
+	"github.com/sato11/the-hack-vm-translator/optimizer"
+	"github.com/sato11/the-hack-vm-translator/parser"
+	"github.com/sato11/the-hack-vm-translator/vm"
+)
+
+const (
+	// RegisterCount is the number of words at the bottom of the RAM which are compared:
+	// SP, LCL, ARG, THIS, THAT and the temp segment.
+	RegisterCount = vm.TempBase + parser.TempSize
+	// HeapBase is the address from which the RAM is compared up to its end.
+	// The this, that, local and argument segments of the programs compared should lie there.
+	HeapBase = 2048
+	// DefaultStepLimit is the number of commands the interpreter may execute unless told otherwise.
+	DefaultStepLimit = 100000
+	// DefaultCycleLimit is the number of instructions the emulator may execute unless told otherwise.
+	DefaultCycleLimit = 10000000
+)
+
+// Options controls how a program is executed by Compare.
+type Options struct {
+	// Bootstrap selects whether execution starts with a call to Sys.init.
+	Bootstrap codewriter.Bootstrap
+	// Configure, if not nil, is applied to the code writer before the translation.
+	Configure func(*codewriter.CodeWriter)
+	// Optimize selects whether the files are run through the VM optimizer before the translation,
+	// while the interpreter still runs them as they are.
+	Optimize bool
+	// RAM holds values stored into the memory before execution, by address.
+	RAM map[int]int16
+	// StepLimit is the number of commands the interpreter may execute, DefaultStepLimit if 0.
+	StepLimit int
+	// CycleLimit is the number of instructions the emulator may execute, DefaultCycleLimit if 0.
+	CycleLimit int
+}
+
+// Mismatch is a location whose value after execution differs between the interpreter
+// and the translated program.
+type Mismatch struct {
+	// Location is either RAM[n] or the name of a static variable, such as Main.0.
+	Location    string
+	Interpreter int16
+	Translation int16
+}
+
+func (m Mismatch) String() string {
+	return fmt.Sprintf("%s: interpreter %d, translation %d", m.Location, m.Interpreter, m.Translation)
+}
+
+// MismatchError is returned by Compare when the executions end in different states.
+type MismatchError struct {
+	Mismatches []Mismatch
+}
+
+func (e *MismatchError) Error() string {
+	lines := make([]string, len(e.Mismatches))
+	for i, m := range e.Mismatches {
+		lines[i] = m.String()
+	}
+	return "difftest: executions differ:\n" + strings.Join(lines, "\n")
+}
+
+// interpret runs files with the VM interpreter.
+func interpret(files []*parser.File, opts Options) (*vm.Machine, error) {
+	m, err := vm.New(files)
+	if err != nil {
+		return nil, err
+	}
+	for address, value := range opts.RAM {
+		m.Poke(address, value)
+	}
+
+	if opts.Bootstrap == codewriter.BootstrapAlways || (opts.Bootstrap == codewriter.BootstrapAuto && m.Defines("Sys.init")) {
+		if err := m.Bootstrap("Sys.init"); err != nil {
+			return nil, err
+		}
+	}
+	limit := opts.StepLimit
+	if limit == 0 {
+		limit = DefaultStepLimit
+	}
+	if err := m.RunUntilHalt(limit); err != nil {
+		return nil, fmt.Errorf("interpreter: %v", err)
+	}
+	return m, nil
+}
+
+// emulate translates files and runs the translation on the emulator,
+// with the stack pointer set to StackBase as the interpreter does.
+func emulate(files []*parser.File, opts Options) (*emulator.Computer, error) {
+	if opts.Optimize {
+		files, _ = optimizer.Optimize(files)
+	}
+
+	var asm bytes.Buffer
+	w := codewriter.NewWriter(&asm)
+	if opts.Configure != nil {
+		opts.Configure(w)
+	}
+	if err := w.WriteProgram(files, opts.Bootstrap); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	program, err := assembler.Assemble("", &asm)
+	if err != nil {
+		return nil, err
+	}
+
+	c := emulator.New(program)
+	c.Poke(vm.SP, vm.StackBase)
+	for address, value := range opts.RAM {
+		c.Poke(address, value)
+	}
+	limit := opts.CycleLimit
+	if limit == 0 {
+		limit = DefaultCycleLimit
+	}
+	if err := c.RunUntilHalt(limit); err != nil {
+		return nil, fmt.Errorf("emulator: %v", err)
+	}
+	return c, nil
+}
+
+// static identifies a static variable.
+type static struct {
+	namespace string
+	index     int
+}
+
+// name returns the name of the variable in the translation, such as Main.0.
+func (s static) name() string {
+	return fmt.Sprintf("%s.%d", s.namespace, s.index)
+}
+
+// statics returns the static variables files refer to, in order of their names.
+func statics(files []*parser.File) []static {
+	seen := make(map[static]bool)
+	var variables []static
+	for _, file := range files {
+		for _, command := range file.Commands {
+			v := static{file.Namespace, command.Index}
+			if command.Segment == parser.StaticSegment && !seen[v] {
+				seen[v] = true
+				variables = append(variables, v)
+			}
+		}
+	}
+	sort.Slice(variables, func(i, j int) bool {
+		return variables[i].name() < variables[j].name()
+	})
+	return variables
+}
+
+// Compare executes files both with the VM interpreter and as translated by the code writer on the emulator,
+// then compares the states they halt in: the registers, the temp segment, the stack up to the stack pointer,
+// the RAM from HeapBase on and the static variables. The return addresses of the calls still in progress
+// when the program halts, such as the call to Sys.init of the bootstrap code, are left out
+// as they are addresses of commands in one case and of Hack instructions in the other.
+// Differences are reported by a *MismatchError; any other error means either execution failed.
+func Compare(files []*parser.File, opts Options) error {
+	m, err := interpret(files, opts)
+	if err != nil {
+		return err
+	}
+	c, err := emulate(files, opts)
+	if err != nil {
+		return err
+	}
+
+	var mismatches []Mismatch
+	compare := func(location string, interpreter, translation int16) {
+		if interpreter != translation {
+			mismatches = append(mismatches, Mismatch{location, interpreter, translation})
+		}
+	}
+
+	skip := make(map[int]bool)
+	for _, address := range m.ReturnAddresses() {
+		skip[address] = true
+	}
+
+	sp := int(m.Peek(vm.SP))
+	if sp < vm.StackBase || sp > HeapBase {
+		sp = vm.StackBase
+	}
+	for address := 0; address < emulator.RAMSize; address++ {
+		if address >= RegisterCount && address < vm.StackBase || address >= sp && address < HeapBase || skip[address] {
+			continue
+		}
+		compare(fmt.Sprintf("RAM[%d]", address), m.Peek(address), c.Peek(address))
+	}
+
+	for _, v := range statics(files) {
+		var value int16
+		if address, ok := c.Symbol(v.name()); ok {
+			value = c.Peek(address)
+		}
+		compare(v.name(), m.Static(v.namespace, v.index), value)
+	}
+
+	if len(mismatches) != 0 {
+		return &MismatchError{mismatches}
+	}
+	return nil
+}
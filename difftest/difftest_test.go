@@ -0,0 +1,149 @@
+package difftest
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sato11/the-hack-vm-translator/codewriter"
+	"github.com/sato11/the-hack-vm-translator/parser"
+)
+
+// parse parses sources, given as file names followed by their code.
+func parse(t *testing.T, sources ...string) []*parser.File {
+	t.Helper()
+	var files []*parser.File
+	for i := 0; i < len(sources); i += 2 {
+		file, err := parser.ParseFile(sources[i], strings.NewReader(sources[i+1]))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+func TestFixtures(t *testing.T) {
+	// The segments are moved to the heap so that they are compared too.
+	segments := map[int]int16{1: 2300, 2: 2400, 3: 3000, 4: 3010, 2400: 3, 2401: 3000}
+	tests := []struct {
+		dir string
+		ram map[int]int16
+	}{
+		{"StackArithmetic/SimpleAdd", nil},
+		{"StackArithmetic/StackTest", nil},
+		{"MemoryAccess/BasicTest", segments},
+		{"MemoryAccess/PointerTest", nil},
+		{"MemoryAccess/StaticTest", nil},
+		{"ProgramFlow/BasicLoop", segments},
+		{"ProgramFlow/FibonacciSeries", segments},
+		{"FunctionCalls/FibonacciElement", nil},
+		{"FunctionCalls/NestedCall", nil},
+		{"FunctionCalls/StaticsTest", nil},
+	}
+
+	for _, tt := range tests {
+		paths, err := filepath.Glob(filepath.Join("..", "testdata", tt.dir, "*.vm"))
+		if err != nil || len(paths) == 0 {
+			t.Fatalf("no .vm files in %s: %v", tt.dir, err)
+		}
+		var sources []string
+		for _, path := range paths {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sources = append(sources, path, string(b))
+		}
+
+		if err := Compare(parse(t, sources...), Options{RAM: tt.ram}); err != nil {
+			t.Errorf("%s: %v", tt.dir, err)
+		}
+		shared := func(w *codewriter.CodeWriter) { w.SetSharedRoutines(true) }
+		if err := Compare(parse(t, sources...), Options{RAM: tt.ram, Configure: shared}); err != nil {
+			t.Errorf("%s with shared routines: %v", tt.dir, err)
+		}
+		optimized := func(w *codewriter.CodeWriter) { w.SetOptimize(true) }
+		if err := Compare(parse(t, sources...), Options{RAM: tt.ram, Configure: optimized, Optimize: true}); err != nil {
+			t.Errorf("%s optimized: %v", tt.dir, err)
+		}
+	}
+}
+
+func TestOverflowingComparison(t *testing.T) {
+	// x-y overflows here, which used to make -32767 > 2 true.
+	files := parse(t, "Main.vm", "push constant 32767\nneg\npush constant 2\ngt\nlabel END\ngoto END\n")
+	if err := Compare(files, Options{Bootstrap: codewriter.BootstrapNever}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMismatchError(t *testing.T) {
+	var err error = &MismatchError{[]Mismatch{{"RAM[256]", 0, -1}, {"Main.0", 3, 4}}}
+	want := "difftest: executions differ:\nRAM[256]: interpreter 0, translation -1\nMain.0: interpreter 3, translation 4"
+	if err.Error() != want {
+		t.Errorf("got: %v wanted: %v", err.Error(), want)
+	}
+}
+
+func TestStatics(t *testing.T) {
+	files := parse(t,
+		"A.vm", "push constant 1\npop static 3\npush static 0\npop temp 0\n",
+		"B.vm", "push constant 2\npop static 3\nlabel END\ngoto END\n",
+	)
+	if err := Compare(files, Options{}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	got := statics(files)
+	want := []static{{"A", 0}, {"A", 3}, {"B", 3}}
+	if len(got) != len(want) {
+		t.Fatalf("got: %v wanted: %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("#%d: got: %v wanted: %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestExecutionError(t *testing.T) {
+	files := parse(t, "Main.vm", "label LOOP\ngoto LOOP2\nlabel LOOP2\ngoto LOOP\n")
+	err := Compare(files, Options{StepLimit: 100})
+	if err == nil || !strings.Contains(err.Error(), "interpreter: vm: program did not halt within 100 steps") {
+		t.Errorf("got: %v wanted: a step limit error", err)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	for seed := int64(0); seed < 10; seed++ {
+		a, _ := Generate(rand.New(rand.NewSource(seed)), 40)
+		b, _ := Generate(rand.New(rand.NewSource(seed)), 40)
+		if Source(a) != Source(b) {
+			t.Errorf("seed %d: generated different programs", seed)
+		}
+		if err := parser.Validate(a); err != nil {
+			t.Errorf("seed %d: generated an invalid program: %v\n%s", seed, err, Source(a))
+		}
+	}
+}
+
+func TestRandomPrograms(t *testing.T) {
+	n := 300
+	if testing.Short() {
+		n = 30
+	}
+	for seed := int64(0); seed < int64(n); seed++ {
+		files, opts := Generate(rand.New(rand.NewSource(seed)), 60)
+		shared, optimize := seed%2 == 1, seed%4 >= 2
+		opts.Optimize = optimize
+		opts.Configure = func(w *codewriter.CodeWriter) {
+			w.SetSharedRoutines(shared)
+			w.SetOptimize(optimize)
+		}
+		if err := Compare(files, opts); err != nil {
+			t.Fatalf("seed %d: %v\n%s", seed, err, Source(files))
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package difftest
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/sato11/the-hack-vm-translator/codewriter"
+	"github.com/sato11/the-hack-vm-translator/parser"
+)
+
+const (
+	// localBase and argumentBase are where the local and argument segments of top-level code lie.
+	localBase    = HeapBase + 400
+	argumentBase = HeapBase + 500
+	// thisBase and thatBase are where the this and that segments lie.
+	thisBase = HeapBase + 1000
+	thatBase = HeapBase + 2000
+	// segmentSize is the number of words of the this, that, local and argument segments of top-level code.
+	segmentSize = 8
+	// staticCount is the number of static variables of each file used as plain variables.
+	// The following ones serve as loop counters.
+	staticCount = 4
+	// maxLoops bounds the number of loops of a program, each of which has a counter of its own.
+	maxLoops = 16
+)
+
+// binaryOperators and unaryOperators are the arithmetic and logical commands programs are made of.
+var (
+	binaryOperators = []string{"add", "sub", "and", "or", "eq", "gt", "lt"}
+	unaryOperators  = []string{"neg", "not"}
+)
+
+// function describes a generated function.
+type function struct {
+	name string
+	args int
+}
+
+// scope describes the code a block of commands is generated in.
+type scope struct {
+	locals int
+	args   int
+	// callees are the functions the block may call, all defined beforehand so that nothing recurses.
+	callees []function
+}
+
+// generator writes random VM code.
+type generator struct {
+	r      *rand.Rand
+	code   strings.Builder
+	labels int
+	loops  int
+}
+
+func (g *generator) emit(format string, a ...interface{}) {
+	fmt.Fprintf(&g.code, format+"\n", a...)
+}
+
+// label returns a label unused so far.
+func (g *generator) label(prefix string) string {
+	g.labels++
+	return fmt.Sprintf("%s%d", prefix, g.labels)
+}
+
+// push pushes a random value readable in s.
+func (g *generator) push(s scope) {
+	for {
+		switch g.r.Intn(8) {
+		case 0, 1:
+			g.emit("push constant %d", g.r.Intn(parser.MaxConstant+1))
+		case 2:
+			g.emit("push constant %d", g.r.Intn(4))
+		case 3:
+			if s.locals == 0 {
+				continue
+			}
+			g.emit("push local %d", g.r.Intn(s.locals))
+		case 4:
+			if s.args == 0 {
+				continue
+			}
+			g.emit("push argument %d", g.r.Intn(s.args))
+		case 5:
+			segment := []string{"this", "that", "pointer"}[g.r.Intn(3)]
+			size := segmentSize
+			if segment == "pointer" {
+				size = parser.PointerSize
+			}
+			g.emit("push %s %d", segment, g.r.Intn(size))
+		case 6:
+			g.emit("push temp %d", g.r.Intn(parser.TempSize))
+		case 7:
+			g.emit("push static %d", g.r.Intn(staticCount))
+		}
+		return
+	}
+}
+
+// pop pops the top of the stack into a random location writable in s.
+// The pointer segment is left alone so that this and that keep their bases.
+func (g *generator) pop(s scope) {
+	for {
+		switch g.r.Intn(5) {
+		case 0:
+			if s.locals == 0 {
+				continue
+			}
+			g.emit("pop local %d", g.r.Intn(s.locals))
+		case 1:
+			if s.args == 0 {
+				continue
+			}
+			g.emit("pop argument %d", g.r.Intn(s.args))
+		case 2:
+			g.emit("pop %s %d", []string{"this", "that"}[g.r.Intn(2)], g.r.Intn(segmentSize))
+		case 3:
+			g.emit("pop temp %d", g.r.Intn(parser.TempSize))
+		case 4:
+			g.emit("pop static %d", g.r.Intn(staticCount))
+		}
+		return
+	}
+}
+
+// balanced generates a block of about n commands which leaves the stack as deep as it finds it.
+func (g *generator) balanced(s scope, depth, n int) {
+	d := g.block(s, depth, n)
+	for ; d > depth; d-- {
+		g.pop(s)
+	}
+	for ; d < depth; d++ {
+		g.push(s)
+	}
+}
+
+// block generates about n commands given a stack depth, and returns the depth they leave.
+func (g *generator) block(s scope, depth, n int) int {
+	for i := 0; i < n; i++ {
+		switch k := g.r.Intn(16); {
+		case k < 5:
+			g.push(s)
+			depth++
+		case k < 8 && depth >= 1:
+			g.pop(s)
+			depth--
+		case k < 11 && depth >= 2:
+			g.emit(binaryOperators[g.r.Intn(len(binaryOperators))])
+			depth--
+		case k < 12 && depth >= 1:
+			g.emit(unaryOperators[g.r.Intn(len(unaryOperators))])
+		case k < 14 && len(s.callees) != 0:
+			callee := s.callees[g.r.Intn(len(s.callees))]
+			for j := 0; j < callee.args; j++ {
+				g.push(s)
+			}
+			g.emit("call %s %d", callee.name, callee.args)
+			depth++
+		case k < 15 && depth >= 1 && n-i > 2:
+			// if-goto over a block
+			skip := g.label("SKIP")
+			g.emit("if-goto %s", skip)
+			depth--
+			size := g.r.Intn(n - i)
+			g.balanced(s, depth, size)
+			g.emit("label %s", skip)
+			i += size
+		case k < 16 && g.loops < maxLoops && n-i > 2:
+			// a loop running 1 to 3 times, counted down in a static variable of its own
+			counter := staticCount + g.loops
+			g.loops++
+			loop := g.label("LOOP")
+			g.emit("push constant %d", 1+g.r.Intn(3))
+			g.emit("pop static %d", counter)
+			g.emit("label %s", loop)
+			size := g.r.Intn(n - i)
+			g.balanced(s, depth, size)
+			g.emit("push static %d", counter)
+			g.emit("push constant 1")
+			g.emit("sub")
+			g.emit("pop static %d", counter)
+			g.emit("push static %d", counter)
+			g.emit("push constant 0")
+			g.emit("eq")
+			g.emit("not")
+			g.emit("if-goto %s", loop)
+			i += size
+		}
+	}
+	return depth
+}
+
+// file parses the code generated so far as the file name, and starts a new one.
+func (g *generator) file(name string) *parser.File {
+	file, err := parser.ParseFile(name, strings.NewReader(g.code.String()))
+	if err != nil {
+		panic(fmt.Sprintf("difftest: generated invalid code: %v\n%s", err, g.code.String()))
+	}
+	g.code.Reset()
+	return file
+}
+
+// Generate returns a random program of about size commands, which halts without accessing memory
+// out of the segments, along with the options to compare its executions with.
+// The program is made of a file of functions, which call each other without recursion,
+// and of either top-level code or Sys.init calling them.
+func Generate(r *rand.Rand, size int) ([]*parser.File, Options) {
+	g := &generator{r: r}
+	opts := Options{RAM: map[int]int16{}}
+	for i := 0; i < segmentSize; i++ {
+		for _, base := range []int{localBase, argumentBase, thisBase, thatBase} {
+			opts.RAM[base+i] = int16(r.Intn(1 << 16))
+		}
+	}
+
+	var functions []function
+	n := r.Intn(4)
+	for i := 0; i < n; i++ {
+		f := function{fmt.Sprintf("Lib.f%d", i), r.Intn(3)}
+		locals := r.Intn(3)
+		g.emit("function %s %d", f.name, locals)
+		depth := g.block(scope{locals, f.args, functions}, 0, size/(n+1))
+		if depth == 0 {
+			g.push(scope{locals, f.args, nil})
+		}
+		g.emit("return")
+		functions = append(functions, f)
+	}
+	var lib *parser.File
+	if n != 0 {
+		lib = g.file("Lib.vm")
+	}
+
+	var main *parser.File
+	if r.Intn(2) == 0 {
+		opts.Bootstrap = codewriter.BootstrapAuto
+		locals := r.Intn(3)
+		g.emit("function Sys.init %d", locals)
+		g.emit("push constant %d", thisBase)
+		g.emit("pop pointer 0")
+		g.emit("push constant %d", thatBase)
+		g.emit("pop pointer 1")
+		g.block(scope{locals, 0, functions}, 0, size/(n+1))
+		g.emit("label END")
+		g.emit("goto END")
+		main = g.file("Sys.vm")
+	} else {
+		opts.Bootstrap = codewriter.BootstrapNever
+		opts.RAM[1] = localBase
+		opts.RAM[2] = argumentBase
+		g.emit("push constant %d", thisBase)
+		g.emit("pop pointer 0")
+		g.emit("push constant %d", thatBase)
+		g.emit("pop pointer 1")
+		g.block(scope{segmentSize, segmentSize, functions}, 0, size/(n+1))
+		g.emit("label END")
+		g.emit("goto END")
+		main = g.file("Main.vm")
+	}
+
+	if lib == nil {
+		return []*parser.File{main}, opts
+	}
+	return []*parser.File{main, lib}, opts
+}
+
+// Source returns the VM code of files, each preceded by a comment naming it.
+func Source(files []*parser.File) string {
+	var b strings.Builder
+	for _, file := range files {
+		fmt.Fprintf(&b, "// %s\n", file.Name)
+		for _, command := range file.Commands {
+			fmt.Fprintln(&b, command.String())
+		}
+	}
+	return b.String()
+}
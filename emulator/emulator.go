@@ -0,0 +1,217 @@
+package emulator
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/sato11/the-hack-vm-translator/assembler"
+)
+
+// RAMSize is the number of words of the data memory.
+const RAMSize = 32768
+
+// ErrHalted is returned by Step when the computer has halted.
+var ErrHalted = errors.New("emulator: halted")
+
+// CycleLimitError is returned by RunUntilHalt when the program does not halt in time.
+type CycleLimitError struct {
+	Limit int
+}
+
+func (e *CycleLimitError) Error() string {
+	return fmt.Sprintf("emulator: program did not halt within %d cycles", e.Limit)
+}
+
+// AddressError is returned by Step when an instruction accesses memory out of the RAM.
+type AddressError struct {
+	PC      int
+	Address uint16
+}
+
+func (e *AddressError) Error() string {
+	return fmt.Sprintf("emulator: instruction %d accesses RAM[%d] out of range", e.PC, e.Address)
+}
+
+// Computer simulates the Hack computer, made of the CPU, its instruction memory and its data memory.
+type Computer struct {
+	// A and D are the registers of the CPU.
+	A, D int16
+	// PC is the address of the next instruction to execute.
+	PC int
+	// RAM is the data memory.
+	RAM [RAMSize]int16
+	// Cycles counts the instructions executed so far.
+	Cycles int
+
+	program *assembler.Program
+	halted  bool
+}
+
+// New creates a computer whose instruction memory holds program.
+func New(program *assembler.Program) *Computer {
+	return &Computer{program: program}
+}
+
+// LoadAsm assembles the Hack assembly code read from r and loads it into a new computer.
+func LoadAsm(r io.Reader) (*Computer, error) {
+	program, err := assembler.Assemble("", r)
+	if err != nil {
+		return nil, err
+	}
+	return New(program), nil
+}
+
+// LoadHack loads the Hack machine code read from r into a new computer.
+func LoadHack(r io.Reader) (*Computer, error) {
+	program, err := assembler.ReadHack("", r)
+	if err != nil {
+		return nil, err
+	}
+	return New(program), nil
+}
+
+// Reset sets the program counter back to the first instruction, leaving the memory as is.
+func (c *Computer) Reset() {
+	c.PC = 0
+	c.Cycles = 0
+	c.halted = false
+}
+
+// Halted reports whether the program has come to an end,
+// either by running past its last instruction or by entering a loop that jumps onto itself,
+// as in (END) @END 0;JMP.
+func (c *Computer) Halted() bool {
+	return c.halted || c.PC < 0 || c.PC >= len(c.program.Instructions)
+}
+
+// Peek returns the value of RAM[address].
+func (c *Computer) Peek(address int) int16 {
+	return c.RAM[address]
+}
+
+// Poke sets RAM[address] to value.
+func (c *Computer) Poke(address int, value int16) {
+	c.RAM[address] = value
+}
+
+// Symbol returns the address the symbol was assembled to.
+// The second return value reports whether the program knows the symbol.
+func (c *Computer) Symbol(symbol string) (int, bool) {
+	if !c.program.Symbols.Contains(symbol) {
+		return 0, false
+	}
+	return int(c.program.Symbols.GetAddress(symbol)), true
+}
+
+// alu computes the comp bits of a C-instruction, zx nx zy ny f no, with x = D and y = A or M.
+func alu(comp uint16, x, y int16) int16 {
+	if comp&0x20 != 0 { // zx
+		x = 0
+	}
+	if comp&0x10 != 0 { // nx
+		x = ^x
+	}
+	if comp&0x08 != 0 { // zy
+		y = 0
+	}
+	if comp&0x04 != 0 { // ny
+		y = ^y
+	}
+	var out int16
+	if comp&0x02 != 0 { // f
+		out = x + y
+	} else {
+		out = x & y
+	}
+	if comp&0x01 != 0 { // no
+		out = ^out
+	}
+	return out
+}
+
+// jumps reports whether the jump bits of a C-instruction are satisfied by out.
+func jumps(jump uint16, out int16) bool {
+	return (jump&4 != 0 && out < 0) || (jump&2 != 0 && out == 0) || (jump&1 != 0 && out > 0)
+}
+
+// Step executes a single instruction.
+func (c *Computer) Step() error {
+	if c.Halted() {
+		return ErrHalted
+	}
+
+	instruction := c.program.Instructions[c.PC]
+	c.Cycles++
+
+	// A-instruction
+	if instruction&0x8000 == 0 {
+		c.A = int16(instruction)
+		c.PC++
+		return nil
+	}
+
+	// C-instruction: 111a cccc ccdd djjj
+	address := uint16(c.A)
+	usesM := instruction&0x1000 != 0
+	dest := (instruction >> 3) & 7
+	if (usesM || dest&1 != 0) && address >= RAMSize {
+		c.Cycles--
+		return &AddressError{c.PC, address}
+	}
+
+	y := c.A
+	if usesM {
+		y = c.RAM[address]
+	}
+	out := alu((instruction>>6)&0x3f, c.D, y)
+
+	if dest&1 != 0 {
+		c.RAM[address] = out
+	}
+	if dest&4 != 0 {
+		c.A = out
+	}
+	if dest&2 != 0 {
+		c.D = out
+	}
+
+	jump := instruction & 7
+	if !jumps(jump, out) {
+		c.PC++
+		return nil
+	}
+
+	target := int(address)
+	if jump == 7 && target == c.PC-1 && c.program.Instructions[target] == address {
+		c.halted = true
+	}
+	c.PC = target
+	return nil
+}
+
+// Run executes at most n instructions, stopping early if the program halts.
+// It returns the number of instructions executed.
+func (c *Computer) Run(n int) (int, error) {
+	for i := 0; i < n; i++ {
+		if c.Halted() {
+			return i, nil
+		}
+		if err := c.Step(); err != nil {
+			return i, err
+		}
+	}
+	return n, nil
+}
+
+// RunUntilHalt executes instructions until the program halts,
+// giving up with a *CycleLimitError after limit instructions.
+func (c *Computer) RunUntilHalt(limit int) error {
+	if _, err := c.Run(limit); err != nil {
+		return err
+	}
+	if !c.Halted() {
+		return &CycleLimitError{limit}
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package emulator
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/sato11/the-hack-vm-translator/assembler"
+)
+
+const max = `
+   @R0
+   D=M
+   @R1
+   D=D-M
+   @OUTPUT_FIRST
+   D;JGT
+   @R1
+   D=M
+   @OUTPUT_D
+   0;JMP
+(OUTPUT_FIRST)
+   @R0
+   D=M
+(OUTPUT_D)
+   @R2
+   M=D
+(INFINITE_LOOP)
+   @INFINITE_LOOP
+   0;JMP
+`
+
+type maxTest struct {
+	r0, r1, r2 int16
+}
+
+func TestMax(t *testing.T) {
+	tests := []maxTest{
+		{0, 0, 0},
+		{1, 0, 1},
+		{0, 1, 1},
+		{-1, -2, -1},
+		{12345, 23456, 23456},
+	}
+
+	for i, test := range tests {
+		c, err := LoadAsm(strings.NewReader(max))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		c.Poke(0, test.r0)
+		c.Poke(1, test.r1)
+		if err := c.RunUntilHalt(100); err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if c.Peek(2) != test.r2 {
+			t.Errorf("#%d: got: %v wanted: %v", i, c.Peek(2), test.r2)
+		}
+		if c.PC != 14 {
+			t.Errorf("#%d: got: %v wanted: halted at %v", i, c.PC, 14)
+		}
+	}
+}
+
+type aluTest struct {
+	instruction string
+	d, a, m     int16
+	out         int16
+}
+
+func TestALU(t *testing.T) {
+	tests := []aluTest{
+		{"D=0", 5, 7, 9, 0},
+		{"D=1", 5, 7, 9, 1},
+		{"D=-1", 5, 7, 9, -1},
+		{"D=D", 5, 7, 9, 5},
+		{"D=A", 5, 7, 9, 7},
+		{"D=M", 5, 7, 9, 9},
+		{"D=!D", 5, 7, 9, ^int16(5)},
+		{"D=!M", 5, 7, 9, ^int16(9)},
+		{"D=-D", 5, 7, 9, -5},
+		{"D=-A", 5, 7, 9, -7},
+		{"D=D+1", 5, 7, 9, 6},
+		{"D=M+1", 5, 7, 9, 10},
+		{"D=D-1", 5, 7, 9, 4},
+		{"D=A-1", 5, 7, 9, 6},
+		{"D=D+A", 5, 7, 9, 12},
+		{"D=D+M", 5, 7, 9, 14},
+		{"D=D-A", 5, 7, 9, -2},
+		{"D=M-D", 5, 7, 9, 4},
+		{"D=D&M", 5, 7, 9, 1},
+		{"D=D|A", 5, 7, 9, 7},
+		{"D=D+A", 32767, 1, 0, -32768},
+	}
+
+	for i, test := range tests {
+		c, err := LoadAsm(strings.NewReader(test.instruction))
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		c.D, c.A = test.d, test.a
+		c.Poke(int(test.a), test.m)
+		if err := c.Step(); err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if c.D != test.out {
+			t.Errorf("#%d: got: %v wanted: %v", i, c.D, test.out)
+		}
+	}
+}
+
+func TestDest(t *testing.T) {
+	c, err := LoadAsm(strings.NewReader("@100\nAMD=A+1\n@200\nM=1\nAM=M+1"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := c.Run(2); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.A != 101 || c.D != 101 || c.Peek(100) != 101 {
+		t.Errorf("got: A=%v D=%v RAM[100]=%v wanted: 101", c.A, c.D, c.Peek(100))
+	}
+
+	if _, err := c.Run(3); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.A != 2 || c.Peek(200) != 2 {
+		t.Errorf("got: A=%v RAM[200]=%v wanted: 2", c.A, c.Peek(200))
+	}
+	if !c.Halted() || c.Cycles != 5 {
+		t.Errorf("got: halted %v after %v cycles wanted: halted after 5 cycles", c.Halted(), c.Cycles)
+	}
+	if err := c.Step(); err != ErrHalted {
+		t.Errorf("got: %v wanted: %v", err, ErrHalted)
+	}
+}
+
+type jumpTest struct {
+	jump string
+	d    int16
+	out  bool
+}
+
+func TestJump(t *testing.T) {
+	tests := []jumpTest{
+		{"JGT", 1, true}, {"JGT", 0, false}, {"JGT", -1, false},
+		{"JEQ", 1, false}, {"JEQ", 0, true}, {"JEQ", -1, false},
+		{"JGE", 1, true}, {"JGE", 0, true}, {"JGE", -1, false},
+		{"JLT", 1, false}, {"JLT", 0, false}, {"JLT", -1, true},
+		{"JNE", 1, true}, {"JNE", 0, false}, {"JNE", -1, true},
+		{"JLE", 1, false}, {"JLE", 0, true}, {"JLE", -1, true},
+		{"JMP", 1, true}, {"JMP", 0, true}, {"JMP", -1, true},
+	}
+
+	for i, test := range tests {
+		c, err := LoadAsm(strings.NewReader("@10\nD;" + test.jump))
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		c.D = test.d
+		c.Run(2)
+		if (c.PC == 10) != test.out {
+			t.Errorf("#%d: got: PC=%v wanted: jump %v", i, c.PC, test.out)
+		}
+	}
+}
+
+func TestRunUntilHalt(t *testing.T) {
+	c, err := LoadAsm(strings.NewReader("(LOOP)\n@R0\nM=M+1\n@LOOP\n0;JMP"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var e *CycleLimitError
+	if err := c.RunUntilHalt(100); !errors.As(err, &e) || e.Limit != 100 {
+		t.Errorf("got: %v wanted: *CycleLimitError", err)
+	}
+	if c.Peek(0) != 25 {
+		t.Errorf("got: %v wanted: %v", c.Peek(0), 25)
+	}
+
+	c, err = LoadAsm(strings.NewReader("@32767\nD=A\n@0\nA=D+A\nA=A+1\nM=1"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var a *AddressError
+	if err := c.RunUntilHalt(100); !errors.As(err, &a) || a.PC != 5 {
+		t.Errorf("got: %v wanted: *AddressError", err)
+	}
+}
+
+func TestLoadHack(t *testing.T) {
+	program, err := assembler.Assemble("Max.asm", strings.NewReader(max))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var b bytes.Buffer
+	program.WriteHack(&b)
+
+	c, err := LoadHack(&b)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c.Poke(0, 3)
+	c.Poke(1, 8)
+	if err := c.RunUntilHalt(100); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.Peek(2) != 8 {
+		t.Errorf("got: %v wanted: %v", c.Peek(2), 8)
+	}
+}
+
+func TestSymbol(t *testing.T) {
+	c, err := LoadAsm(strings.NewReader("@Main.0\nM=1\n@Main.1\nM=-1\n(END)"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c.RunUntilHalt(10)
+
+	address, ok := c.Symbol("Main.1")
+	if !ok || c.Peek(address) != -1 {
+		t.Errorf("got: %v, %v wanted: %v", address, ok, 17)
+	}
+	if _, ok := c.Symbol("Main.2"); ok {
+		t.Errorf("got: %v wanted: %v", ok, false)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sato11/the-hack-vm-translator/codewriter"
+	"github.com/sato11/the-hack-vm-translator/parser"
+	"github.com/sato11/the-hack-vm-translator/vm"
+)
+
+const runUsage = `Usage: %s run [flags] path...
+
+Executes the program made of all of the paths with the VM interpreter,
+then prints the number of commands executed and the values left on the stack.
+Each path is either a .vm file or a directory holding .vm files, as when translating.
+
+Execution starts with a call to the entry point, Sys.init unless -entry is given,
+if the program defines it, unless told otherwise, and at the first command of the first file otherwise.
+
+Flags:
+`
+
+// breakpoints collects the values of the repeatable -break flag.
+type breakpoints []string
+
+func (b *breakpoints) String() string {
+	return strings.Join(*b, ",")
+}
+
+func (b *breakpoints) Set(value string) error {
+	*b = append(*b, value)
+	return nil
+}
+
+// setBreakpoint sets a breakpoint on the machine m running the files at paths.
+// spec is either file.vm:line, where file.vm is one of paths or the base name of one, or a function name.
+func setBreakpoint(m *vm.Machine, paths []string, spec string) error {
+	if i := strings.LastIndex(spec, ":"); i >= 0 && strings.HasSuffix(spec[:i], ".vm") {
+		line, err := strconv.Atoi(spec[i+1:])
+		if err != nil {
+			return fmt.Errorf("invalid breakpoint %q", spec)
+		}
+		for _, path := range paths {
+			if filepath.Clean(path) == filepath.Clean(spec[:i]) || filepath.Base(path) == spec[:i] {
+				return m.BreakAt(path, line)
+			}
+		}
+		return fmt.Errorf("invalid breakpoint %q: %s is not part of the program", spec, spec[:i])
+	}
+	return m.BreakIn(spec)
+}
+
+// printState prints the values on the stack of m.
+func printState(w io.Writer, m *vm.Machine) {
+	values := make([]string, 0, len(m.Stack()))
+	for _, value := range m.Stack() {
+		values = append(values, strconv.Itoa(int(value)))
+	}
+	fmt.Fprintf(w, "stack: %s\n", strings.Join(values, " "))
+}
+
+// interpret executes the interpreter with the command-line arguments args and returns its exit code.
+func interpret(args []string, stdout, stderr io.Writer) int {
+	var bootstrap, noBootstrap, recursive, trace bool
+	var entry string
+	var limit int
+	var breaks breakpoints
+
+	flags := flag.NewFlagSet(name+" run", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, runUsage, name)
+		flags.PrintDefaults()
+	}
+	flags.BoolVar(&bootstrap, "bootstrap", false, "always start with a call to the entry point (-entry)\n(by default only if the entry point is defined)")
+	flags.BoolVar(&noBootstrap, "no-bootstrap", false, "never start with a call to the entry point")
+	flags.StringVar(&entry, "entry", "Sys.init", entryUsage)
+	flags.BoolVar(&recursive, "r", false, "also run the .vm files in subdirectories of a directory")
+	flags.IntVar(&limit, "limit", 1000000, "give up after `n` commands")
+	flags.BoolVar(&trace, "trace", false, "print every command executed on standard error")
+	flags.Var(&breaks, "break", "print the stack whenever `file.vm:line` or the entry of a function is reached;\nmay be repeated")
+
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitCodeOK
+		}
+		return ExitCodeUsage
+	}
+
+	inputs := flags.Args()
+	if len(inputs) == 0 {
+		return usageError(stderr, "no input path given")
+	}
+	if limit <= 0 {
+		return usageError(stderr, "-limit must be positive")
+	}
+	mode, err := bootstrapMode(flags, bootstrap, noBootstrap)
+	if err != nil {
+		return usageError(stderr, "%v", err)
+	}
+
+	if err := interpretProgram(inputs, recursive, mode, entry, limit, trace, breaks, stdout, stderr); err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return ExitCodeError
+	}
+	return ExitCodeOK
+}
+
+// interpretProgram loads the program made of inputs into the interpreter and runs it.
+func interpretProgram(inputs []string, recursive bool, mode codewriter.Bootstrap, entry string, limit int, trace bool, breaks []string, stdout, stderr io.Writer) error {
+	paths, err := programFiles(inputs, recursive)
+	if err != nil {
+		return err
+	}
+	files, errs := parseFiles(paths)
+	if err, ok := parser.Validate(files).(parser.ErrorList); ok {
+		errs = append(errs, err...)
+	}
+	if len(errs) != 0 {
+		errs.Sort()
+		return errs
+	}
+
+	m, err := vm.New(files)
+	if err != nil {
+		return err
+	}
+	for _, spec := range breaks {
+		if err := setBreakpoint(m, paths, spec); err != nil {
+			return err
+		}
+	}
+	if mode == codewriter.BootstrapAlways || (mode == codewriter.BootstrapAuto && m.Defines(entry)) {
+		if err := m.Bootstrap(entry); err != nil {
+			return err
+		}
+	}
+
+	for !m.Halted() {
+		if m.AtBreakpoint() {
+			fmt.Fprintf(stdout, "break at %s: %s\n", m.Command().Pos, m.Command())
+			printState(stdout, m)
+		}
+		if trace {
+			fmt.Fprintf(stderr, "%s: %s\n", m.Command().Pos, m.Command())
+		}
+		if m.Steps == limit {
+			return &vm.StepLimitError{Limit: limit}
+		}
+		if err := m.Step(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(stdout, "halted after %d steps\n", m.Steps)
+	printState(stdout, m)
+	return nil
+}
@@ -0,0 +1,223 @@
+// Package linker analyses the program made of several parsed .vm files as a whole.
+package linker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sato11/the-hack-vm-translator/assembler"
+	"github.com/sato11/the-hack-vm-translator/parser"
+)
+
+// Function describes the definition of a function.
+type Function struct {
+	// Name is the name of the function, such as Main.main.
+	Name string
+	// Pos is where the function command defining it appears.
+	Pos parser.Position
+	// Commands is the number of commands of the function, its function command included.
+	Commands int
+}
+
+// body locates the commands of a function within a file.
+type body struct {
+	file       *parser.File
+	start, end int
+}
+
+// functions returns the bodies of the functions defined by files, by name, and the calls made by top-level code,
+// that is the commands preceding the first function of a file.
+// A function defined more than once is described by its first definition.
+func functions(files []*parser.File) (map[string]body, []string) {
+	bodies := make(map[string]body)
+	var calls []string
+	for _, file := range files {
+		start := -1
+		for i, command := range file.Commands {
+			switch command.Type {
+			case parser.FunctionCommand:
+				if start >= 0 {
+					define(bodies, file, start, i)
+				}
+				start = i
+			case parser.CallCommand:
+				if start < 0 {
+					calls = append(calls, command.Name)
+				}
+			}
+		}
+		if start >= 0 {
+			define(bodies, file, start, len(file.Commands))
+		}
+	}
+	return bodies, calls
+}
+
+// define adds the function made of the commands start to end of file to bodies, unless it is defined already.
+func define(bodies map[string]body, file *parser.File, start, end int) {
+	name := file.Commands[start].Name
+	if _, ok := bodies[name]; !ok {
+		bodies[name] = body{file, start, end}
+	}
+}
+
+// Reachable returns the names of the functions which may be called when executing files from entry:
+// entry itself, the functions called by top-level code and, in turn, the functions any of them calls.
+// Calls to functions files do not define are left out.
+func Reachable(files []*parser.File, entry string) map[string]bool {
+	bodies, roots := functions(files)
+	reached := make(map[string]bool)
+	queue := append([]string{entry}, roots...)
+	for len(queue) != 0 {
+		name := queue[0]
+		queue = queue[1:]
+		b, ok := bodies[name]
+		if !ok || reached[name] {
+			continue
+		}
+		reached[name] = true
+		for _, command := range b.file.Commands[b.start:b.end] {
+			if command.Type == parser.CallCommand {
+				queue = append(queue, command.Name)
+			}
+		}
+	}
+	return reached
+}
+
+// hasTopLevelCode reports whether any of files has commands outside of functions.
+func hasTopLevelCode(files []*parser.File) bool {
+	for _, file := range files {
+		if len(file.Commands) != 0 && file.Commands[0].Type != parser.FunctionCommand {
+			return true
+		}
+	}
+	return false
+}
+
+// Shake returns files without the functions unreachable from entry, usually Sys.init, along with
+// the functions left out in the order they are defined. Top-level code is always kept, and so are
+// the functions it calls. entry must be defined unless files have top-level code to start from.
+// files are left as they are.
+func Shake(files []*parser.File, entry string) ([]*parser.File, []Function, error) {
+	bodies, _ := functions(files)
+	if _, ok := bodies[entry]; !ok && !hasTopLevelCode(files) {
+		return nil, nil, fmt.Errorf("entry point %s is not defined", entry)
+	}
+	reached := Reachable(files, entry)
+
+	var dropped []Function
+	shaken := make([]*parser.File, len(files))
+	for i, file := range files {
+		shaken[i] = &parser.File{Name: file.Name, Namespace: file.Namespace}
+		keep := true
+		for _, command := range file.Commands {
+			if command.Type == parser.FunctionCommand {
+				keep = reached[command.Name]
+				if !keep {
+					dropped = append(dropped, Function{command.Name, command.Pos, 0})
+				}
+			}
+			if !keep {
+				dropped[len(dropped)-1].Commands++
+				continue
+			}
+			shaken[i].Commands = append(shaken[i].Commands, command)
+		}
+	}
+	return shaken, dropped, nil
+}
+
+// call records where a function is first called and with how many arguments.
+type call struct {
+	pos  parser.Position
+	args int
+}
+
+// Check analyses the calls across files as a linker would, and reports in a parser.ErrorList
+// the calls to functions files do not define, the functions defined more than once, the functions
+// whose name does not begin with the namespace of their file followed by a dot, and the calls passing
+// a function another number of arguments than its first call does. Unless entry is empty, it is
+// reported too if it is not defined and files have no top-level code to start from.
+func Check(files []*parser.File, entry string) error {
+	var errs parser.ErrorList
+	defined := make(map[string]parser.Position)
+	for _, file := range files {
+		for _, command := range file.Commands {
+			if command.Type != parser.FunctionCommand {
+				continue
+			}
+			if pos, ok := defined[command.Name]; ok {
+				errs.Add(command.Pos, fmt.Errorf("function: %s is already defined at %s", command.Name, pos))
+				continue
+			}
+			defined[command.Name] = command.Pos
+			if i := strings.Index(command.Name, "."); i < 0 {
+				errs.Add(command.Pos, fmt.Errorf("function: %s is defined in %s without a namespace, such as %s.%s", command.Name, file.Name, file.Namespace, command.Name))
+			} else if command.Name[:i] != file.Namespace {
+				errs.Add(command.Pos, fmt.Errorf("function: %s is defined in %s, outside of its namespace %s", command.Name, file.Name, command.Name[:i]))
+			}
+		}
+	}
+
+	calls := make(map[string]call)
+	for _, file := range files {
+		for _, command := range file.Commands {
+			if command.Type != parser.CallCommand {
+				continue
+			}
+			if _, ok := defined[command.Name]; !ok {
+				errs.Add(command.Pos, fmt.Errorf("call: function %s is not defined", command.Name))
+			}
+			first, ok := calls[command.Name]
+			if !ok {
+				calls[command.Name] = call{command.Pos, command.Index}
+			} else if command.Index != first.args {
+				errs.Add(command.Pos, fmt.Errorf("call: %s called with %d arguments, but with %d at %s", command.Name, command.Index, first.args, first.pos))
+			}
+		}
+	}
+
+	if _, ok := defined[entry]; entry != "" && !ok && !hasTopLevelCode(files) {
+		errs.Add(parser.Position{}, fmt.Errorf("entry point %s is not defined", entry))
+	}
+	errs.Sort()
+	return errs.Err()
+}
+
+// CheckSymbols reports in a parser.ErrorList the names of files and functions which would clash with other symbols
+// once translated: namespaces which are not valid symbols, and functions named as a symbol predefined by
+// the Hack platform, such as SP or KBD, or as a static variable of the program, such as Main.0.
+// Labels cannot clash, being scoped, and neither can the labels of the translation itself, whose symbols
+// begin with a dollar sign, which VM identifiers cannot hold.
+func CheckSymbols(files []*parser.File) error {
+	var errs parser.ErrorList
+	statics := make(map[string]bool)
+	for _, file := range files {
+		if !parser.IsIdentifier(file.Namespace) {
+			errs.Add(parser.Position{Filename: file.Name}, fmt.Errorf("namespace %q is not a valid symbol", file.Namespace))
+		}
+		for _, command := range file.Commands {
+			if command.Segment == parser.StaticSegment {
+				statics[fmt.Sprintf("%s.%d", file.Namespace, command.Index)] = true
+			}
+		}
+	}
+
+	for _, file := range files {
+		for _, command := range file.Commands {
+			if command.Type != parser.FunctionCommand {
+				continue
+			}
+			switch {
+			case assembler.IsPredefined(command.Name):
+				errs.Add(command.Pos, fmt.Errorf("function: %s is a predefined symbol", command.Name))
+			case statics[command.Name]:
+				errs.Add(command.Pos, fmt.Errorf("function: %s is the symbol of a static variable", command.Name))
+			}
+		}
+	}
+
+	errs.Sort()
+	return errs.Err()
+}
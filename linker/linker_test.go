@@ -0,0 +1,251 @@
+package linker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sato11/the-hack-vm-translator/parser"
+)
+
+// parse parses pairs of file names and sources.
+func parse(t *testing.T, sources ...string) []*parser.File {
+	t.Helper()
+	var files []*parser.File
+	for i := 0; i < len(sources); i += 2 {
+		file, err := parser.ParseFile(sources[i], strings.NewReader(sources[i+1]))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// names returns the names of the functions defined by files, in order.
+func names(files []*parser.File) string {
+	var names []string
+	for _, file := range files {
+		for _, command := range file.Commands {
+			if command.Type == parser.FunctionCommand {
+				names = append(names, command.Name)
+			}
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+func TestShake(t *testing.T) {
+	sys := "function Sys.init 0\ncall Main.main 0\nlabel END\ngoto END\n"
+	main := "function Main.main 0\npush constant 2\ncall Math.double 1\nreturn\n" +
+		"function Main.unused 0\ncall Math.half 1\nreturn\n"
+	math := "function Math.double 0\npush argument 0\npush argument 0\nadd\nreturn\n" +
+		"function Math.half 0\npush constant 0\nreturn\n"
+
+	tests := []struct {
+		name    string
+		files   []*parser.File
+		entry   string
+		kept    string
+		dropped []string
+		err     string
+	}{
+		{
+			"from Sys.init",
+			parse(t, "Sys.vm", sys, "Main.vm", main, "Math.vm", math),
+			"Sys.init",
+			"Sys.init Main.main Math.double",
+			[]string{"Main.unused Main.vm:5:1 3", "Math.half Math.vm:6:1 3"},
+			"",
+		},
+		{
+			"from another entry",
+			parse(t, "Sys.vm", sys, "Main.vm", main, "Math.vm", math),
+			"Main.unused",
+			"Main.unused Math.half",
+			[]string{"Sys.init Sys.vm:1:1 4", "Main.main Main.vm:1:1 4", "Math.double Math.vm:1:1 5"},
+			"",
+		},
+		{
+			"from top-level code",
+			parse(t, "Test.vm", "push constant 1\ncall Math.half 1\nlabel END\ngoto END\n", "Math.vm", math),
+			"Sys.init",
+			"Math.half",
+			[]string{"Math.double Math.vm:1:1 5"},
+			"",
+		},
+		{
+			"undefined entry",
+			parse(t, "Math.vm", math),
+			"Sys.init",
+			"",
+			nil,
+			"entry point Sys.init is not defined",
+		},
+	}
+
+	for _, tt := range tests {
+		before := names(tt.files)
+		shaken, dropped, err := Shake(tt.files, tt.entry)
+		if err != nil {
+			if err.Error() != tt.err {
+				t.Errorf("%s: got: %v wanted: %v", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if tt.err != "" {
+			t.Errorf("%s: got no error wanted: %v", tt.name, tt.err)
+			continue
+		}
+
+		if got := names(shaken); got != tt.kept {
+			t.Errorf("%s: got: %v wanted: %v", tt.name, got, tt.kept)
+		}
+		var got []string
+		for _, f := range dropped {
+			got = append(got, fmt.Sprintf("%s %s %d", f.Name, f.Pos, f.Commands))
+		}
+		if strings.Join(got, ", ") != strings.Join(tt.dropped, ", ") {
+			t.Errorf("%s: got: %v wanted: %v", tt.name, got, tt.dropped)
+		}
+		if names(tt.files) != before {
+			t.Errorf("%s: the files were changed", tt.name)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []*parser.File
+		entry string
+		err   string
+	}{
+		{
+			"valid",
+			parse(t, "Sys.vm", "function Sys.init 0\npush constant 1\ncall Main.f 1\nlabel END\ngoto END\n",
+				"Main.vm", "function Main.f 0\npush argument 0\nreturn\n"),
+			"Sys.init",
+			"",
+		},
+		{
+			"undefined callee",
+			parse(t, "Main.vm", "function Main.f 0\ncall Math.multiply 2\nreturn\n"),
+			"",
+			"Main.vm:2:1: call: function Math.multiply is not defined",
+		},
+		{
+			"duplicate definition",
+			parse(t, "Main.vm", "function Main.f 0\npush constant 0\nreturn\n",
+				"Other.vm", "function Other.g 0\npush constant 0\nreturn\nfunction Main.f 0\npush constant 0\nreturn\n"),
+			"",
+			"Other.vm:4:1: function: Main.f is already defined at Main.vm:1:1",
+		},
+		{
+			"namespace mismatch",
+			parse(t, "Main.vm", "function Main.f 0\npush constant 0\nreturn\nfunction Math.g 0\npush constant 0\nreturn\n"),
+			"",
+			"Main.vm:4:1: function: Math.g is defined in Main.vm, outside of its namespace Math",
+		},
+		{
+			"no namespace",
+			parse(t, "Main.vm", "function main 0\npush constant 0\nreturn\n"),
+			"",
+			"Main.vm:1:1: function: main is defined in Main.vm without a namespace, such as Main.main",
+		},
+		{
+			"inconsistent argument counts",
+			parse(t, "Main.vm", "function Main.f 0\npush constant 0\nreturn\n"+
+				"function Main.g 0\npush constant 1\ncall Main.f 1\npush constant 1\npush constant 2\ncall Main.f 2\nreturn\n"),
+			"",
+			"Main.vm:9:1: call: Main.f called with 2 arguments, but with 1 at Main.vm:6:1",
+		},
+		{
+			"undefined entry",
+			parse(t, "Main.vm", "function Main.f 0\npush constant 0\nreturn\n"),
+			"Sys.init",
+			"entry point Sys.init is not defined",
+		},
+		{
+			"top-level code",
+			parse(t, "Main.vm", "push constant 0\ncall Main.f 1\nlabel END\ngoto END\nfunction Main.f 0\npush constant 0\nreturn\n"),
+			"Sys.init",
+			"",
+		},
+	}
+
+	for _, tt := range tests {
+		got := ""
+		if err := Check(tt.files, tt.entry); err != nil {
+			got = err.Error()
+		}
+		if got != tt.err {
+			t.Errorf("%s: got: %q wanted: %q", tt.name, got, tt.err)
+		}
+	}
+}
+
+func TestCheckFixtures(t *testing.T) {
+	dirs, err := filepath.Glob(filepath.Join("..", "testdata", "*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range dirs {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.vm"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sources []string
+		for _, path := range paths {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sources = append(sources, path, string(b))
+		}
+		if err := Check(parse(t, sources...), ""); err != nil {
+			t.Errorf("%s: %v", dir, err)
+		}
+	}
+}
+
+func TestCheckSymbols(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []*parser.File
+		err   string
+	}{
+		{
+			"valid",
+			parse(t, "Main.vm", "function Main.main 0\npush static 0\nreturn\nfunction Main.1 0\npush constant 0\nreturn\n"),
+			"",
+		},
+		{
+			"predefined symbol",
+			parse(t, "Main.vm", "function KBD 0\npush constant 0\nreturn\nfunction R13 0\npush constant 0\nreturn\n"),
+			"Main.vm:1:1: function: KBD is a predefined symbol\nMain.vm:4:1: function: R13 is a predefined symbol",
+		},
+		{
+			"static variable",
+			parse(t, "Main.vm", "function Main.main 0\npush static 3\nreturn\n", "Other.vm", "function Main.3 0\npush constant 0\nreturn\n"),
+			"Other.vm:1:1: function: Main.3 is the symbol of a static variable",
+		},
+		{
+			"namespace",
+			parse(t, "my-program.vm", "push constant 0\n"),
+			`my-program.vm: namespace "my-program" is not a valid symbol`,
+		},
+	}
+
+	for _, tt := range tests {
+		got := ""
+		if err := CheckSymbols(tt.files); err != nil {
+			got = err.Error()
+		}
+		if got != tt.err {
+			t.Errorf("%s: got: %q wanted: %q", tt.name, got, tt.err)
+		}
+	}
+}
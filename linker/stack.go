@@ -0,0 +1,246 @@
+package linker
+
+import (
+	"fmt"
+
+	"github.com/sato11/the-hack-vm-translator/parser"
+)
+
+const (
+	// StackLimit is the number of words the stack holds, from address 256 up to the heap at 2048.
+	StackLimit = 2048 - 256
+	// FrameSize is the number of words a call pushes besides the arguments:
+	// the return address and the saved LCL, ARG, THIS and THAT.
+	FrameSize = 5
+	// Unbounded is the worst-case depth of code which may recurse or call functions not defined.
+	Unbounded = -1
+)
+
+// StackDepth describes the use of the stack by a function, or by the code of a file outside of functions.
+type StackDepth struct {
+	// Name is the name of the function, or of the file for code outside of functions.
+	Name string
+	// Pos is where the code begins.
+	Pos parser.Position
+	// Locals is the number of local variables of the function, which lie on the stack.
+	Locals int
+	// Max is the maximum number of values the code itself keeps on the stack above its local variables.
+	Max int
+	// Total is the maximum number of words of the stack a call to the function uses, its local variables
+	// and the functions it calls included, or Unbounded.
+	Total int
+	// calls are the calls made by the code, with the depth of the stack before each of them.
+	calls []stackCall
+}
+
+// stackCall is a call command made at some depth of the stack, the arguments included.
+type stackCall struct {
+	function string
+	depth    int
+}
+
+// StackReport is the result of the stack depth analysis of a program.
+type StackReport struct {
+	// Code describes the functions in the order they are defined, followed by the code outside of functions.
+	Code []StackDepth
+	// Total is the maximum number of words of the stack the program uses, or Unbounded.
+	// It includes the frame of the call to the entry point by the bootstrap code.
+	Total int
+}
+
+// effect returns the number of values command pops from the stack and the number it pushes.
+func effect(command parser.Command) (int, int) {
+	switch command.Type {
+	case parser.PushCommand:
+		return 0, 1
+	case parser.PopCommand, parser.IfCommand:
+		return 1, 0
+	case parser.ArithmeticCommand:
+		if command.Name == "neg" || command.Name == "not" {
+			return 1, 1
+		}
+		return 2, 1
+	case parser.CallCommand:
+		return command.Index, 1
+	case parser.ReturnCommand:
+		return 1, 0
+	default:
+		return 0, 0
+	}
+}
+
+// analyzeCode computes the depths of the stack throughout commands, the code of a function or outside of functions,
+// starting from an empty stack. The depth must be the same whichever way a command is reached,
+// no command may pop from an empty stack and return must find a single value on the stack.
+// The code of a function must not run past its last command into the code following it.
+func analyzeCode(commands []parser.Command, function bool, depth *StackDepth, errs *parser.ErrorList) {
+	labels := make(map[string]int)
+	for i, command := range commands {
+		if command.Type == parser.LabelCommand {
+			labels[command.Name] = i
+		}
+	}
+
+	// depths holds the depth of the stack before each command, -1 until it is reached
+	depths := make([]int, len(commands))
+	for i := range depths {
+		depths[i] = -1
+	}
+	reported := make(map[int]bool)
+	var worklist []int
+	reach := func(i, d int) {
+		switch {
+		case i >= len(commands):
+			if function && !reported[i] {
+				reported[i] = true
+				errs.Add(depth.Pos, fmt.Errorf("function: %s runs past its last command without returning", depth.Name))
+			}
+		case depths[i] < 0:
+			depths[i] = d
+			worklist = append(worklist, i)
+		case depths[i] != d && !reported[i]:
+			reported[i] = true
+			errs.Add(commands[i].Pos, fmt.Errorf("%s: reached with %d and with %d values on the stack", commands[i].Type, depths[i], d))
+		}
+	}
+
+	reach(0, 0)
+	for len(worklist) != 0 {
+		i := worklist[len(worklist)-1]
+		worklist = worklist[:len(worklist)-1]
+		command, d := commands[i], depths[i]
+
+		pops, pushes := effect(command)
+		if command.Type == parser.ReturnCommand && d != 1 {
+			errs.Add(command.Pos, fmt.Errorf("return: %d values on the stack, wanted 1", d))
+			continue
+		}
+		if d < pops {
+			errs.Add(command.Pos, fmt.Errorf("%s: pops %d values from a stack of %d", command.Type, pops, d))
+			continue
+		}
+		if command.Type == parser.CallCommand {
+			depth.calls = append(depth.calls, stackCall{command.Name, d})
+		}
+		next := d - pops + pushes
+		if next > depth.Max {
+			depth.Max = next
+		}
+
+		switch command.Type {
+		case parser.GotoCommand:
+			if target, ok := labels[command.Name]; ok {
+				reach(target, next)
+			}
+		case parser.IfCommand:
+			if target, ok := labels[command.Name]; ok {
+				reach(target, next)
+			}
+			reach(i+1, next)
+		case parser.ReturnCommand:
+		default:
+			reach(i+1, next)
+		}
+	}
+}
+
+// AnalyzeStack computes how deep the stack of the program made of files may grow. Each function, and the code
+// of each file outside of functions, is checked to keep the stack at the same depth whichever way a command
+// is reached, never to pop from an empty stack and to return a single value, functions without running past
+// their last command; problems are reported in
+// a parser.ErrorList. Worst-case depths are computed through the call graph, from entry if it is defined
+// and from the code outside of functions, and are Unbounded for code which may recurse or call a function
+// files do not define. Unless entry is empty, it is reported too if it is not defined and files have
+// no top-level code to start from.
+func AnalyzeStack(files []*parser.File, entry string) (*StackReport, error) {
+	var errs parser.ErrorList
+	var functions, topLevel []StackDepth
+	for _, file := range files {
+		start := 0
+		for start < len(file.Commands) && file.Commands[start].Type != parser.FunctionCommand {
+			start++
+		}
+		if start > 0 {
+			code := StackDepth{Name: file.Name, Pos: file.Commands[0].Pos}
+			analyzeCode(file.Commands[:start], false, &code, &errs)
+			topLevel = append(topLevel, code)
+		}
+
+		for start < len(file.Commands) {
+			end := start + 1
+			for end < len(file.Commands) && file.Commands[end].Type != parser.FunctionCommand {
+				end++
+			}
+			function := file.Commands[start]
+			code := StackDepth{Name: function.Name, Pos: function.Pos, Locals: function.Index}
+			analyzeCode(file.Commands[start+1:end], true, &code, &errs)
+			functions = append(functions, code)
+			start = end
+		}
+	}
+
+	// the worst cases of the functions, computed depth first, Unbounded while in progress to cut recursion
+	indices := make(map[string]int)
+	for i, f := range functions {
+		if _, ok := indices[f.Name]; !ok {
+			indices[f.Name] = i
+		}
+	}
+	if _, ok := indices[entry]; entry != "" && !ok && !hasTopLevelCode(files) {
+		errs.Add(parser.Position{}, fmt.Errorf("entry point %s is not defined", entry))
+	}
+	done := make(map[string]bool)
+	var total func(code *StackDepth) int
+	total = func(code *StackDepth) int {
+		worst := code.Max
+		for _, call := range code.calls {
+			i, ok := indices[call.function]
+			if !ok {
+				return Unbounded
+			}
+			callee := &functions[i]
+			if !done[callee.Name] {
+				if callee.Total == Unbounded {
+					return Unbounded
+				}
+				callee.Total = Unbounded
+				callee.Total = total(callee)
+				done[callee.Name] = true
+			}
+			if callee.Total == Unbounded {
+				return Unbounded
+			}
+			if d := call.depth + FrameSize + callee.Total; d > worst {
+				worst = d
+			}
+		}
+		return code.Locals + worst
+	}
+
+	report := &StackReport{}
+	for i := range functions {
+		if !done[functions[i].Name] {
+			functions[i].Total = Unbounded
+			functions[i].Total = total(&functions[i])
+			done[functions[i].Name] = true
+		}
+	}
+	if i, ok := indices[entry]; ok {
+		report.Total = FrameSize + functions[i].Total
+		if functions[i].Total == Unbounded {
+			report.Total = Unbounded
+		}
+	}
+	for i := range topLevel {
+		topLevel[i].Total = total(&topLevel[i])
+		if topLevel[i].Total == Unbounded {
+			report.Total = Unbounded
+		} else if report.Total != Unbounded && topLevel[i].Total > report.Total {
+			report.Total = topLevel[i].Total
+		}
+	}
+	report.Code = append(functions, topLevel...)
+
+	errs.Sort()
+	return report, errs.Err()
+}
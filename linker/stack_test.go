@@ -0,0 +1,172 @@
+package linker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sato11/the-hack-vm-translator/vm"
+)
+
+func TestAnalyzeStack(t *testing.T) {
+	sys := "function Sys.init 0\npush constant 2\ncall Main.double 1\npop temp 0\nlabel END\ngoto END\n"
+	main := "function Main.double 1\n" +
+		"push argument 0\npush argument 0\nadd\npop local 0\n" +
+		"push local 0\nlabel LOOP\npush constant 1\nsub\npush local 0\nif-goto LOOP\nreturn\n"
+
+	tests := []struct {
+		name    string
+		sources []string
+		entry   string
+		depths  []string
+		total   int
+		err     string
+	}{
+		{
+			"calls",
+			[]string{"Sys.vm", sys, "Main.vm", main},
+			"Sys.init",
+			[]string{"Sys.init 0 1 9", "Main.double 1 2 3"},
+			14,
+			"",
+		},
+		{
+			"recursion",
+			[]string{"Main.vm", "function Main.f 0\npush argument 0\nif-goto REC\npush constant 0\nreturn\n" +
+				"label REC\npush constant 0\ncall Main.f 1\nreturn\n"},
+			"Main.f",
+			[]string{"Main.f 0 1 -1"},
+			Unbounded,
+			"",
+		},
+		{
+			"undefined callee",
+			[]string{"Main.vm", "function Main.f 0\ncall Math.g 0\nreturn\n", "Test.vm", "push constant 1\npush constant 2\nadd\n"},
+			"Sys.init",
+			[]string{"Main.f 0 1 -1", "Test.vm 0 2 2"},
+			2,
+			"",
+		},
+		{
+			"top-level code",
+			[]string{"Test.vm", "push constant 1\npush constant 2\ncall Main.f 2\nlabel END\ngoto END\n",
+				"Main.vm", "function Main.f 2\npush constant 0\nreturn\n"},
+			"Sys.init",
+			[]string{"Main.f 2 1 3", "Test.vm 0 2 10"},
+			10,
+			"",
+		},
+		{
+			"errors",
+			[]string{"Main.vm", "function Main.f 0\nadd\npush constant 0\nreturn\n" +
+				"function Main.g 0\npush constant 0\nif-goto SKIP\npush constant 1\nlabel SKIP\npush constant 0\nreturn\n" +
+				"function Main.h 0\npush constant 0\npush constant 0\nreturn\n"},
+			"",
+			nil,
+			0,
+			"Main.vm:2:1: arithmetic: pops 2 values from a stack of 0\n" +
+				"Main.vm:9:1: label: reached with 0 and with 1 values on the stack\n" +
+				"Main.vm:15:1: return: 2 values on the stack, wanted 1",
+		},
+		{
+			"no return",
+			[]string{"Main.vm", "function Main.f 0\npush constant 1\nreturn\nfunction Main.g 0\npush constant 1\n"},
+			"",
+			nil,
+			0,
+			"Main.vm:4:1: function: Main.g runs past its last command without returning",
+		},
+		{
+			"undefined entry",
+			[]string{"Main.vm", main},
+			"Sys.init",
+			nil,
+			0,
+			"entry point Sys.init is not defined",
+		},
+	}
+
+	for _, tt := range tests {
+		report, err := AnalyzeStack(parse(t, tt.sources...), tt.entry)
+		if err != nil {
+			if err.Error() != tt.err {
+				t.Errorf("%s: got: %v wanted: %v", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if tt.err != "" {
+			t.Errorf("%s: got no error wanted: %v", tt.name, tt.err)
+			continue
+		}
+
+		var depths []string
+		for _, d := range report.Code {
+			depths = append(depths, fmt.Sprintf("%s %d %d %d", d.Name, d.Locals, d.Max, d.Total))
+		}
+		if strings.Join(depths, ", ") != strings.Join(tt.depths, ", ") {
+			t.Errorf("%s: got: %v wanted: %v", tt.name, depths, tt.depths)
+		}
+		if report.Total != tt.total {
+			t.Errorf("%s: got: %v wanted: %v", tt.name, report.Total, tt.total)
+		}
+	}
+}
+
+func TestAnalyzeStackFixtures(t *testing.T) {
+	dirs, err := filepath.Glob(filepath.Join("..", "testdata", "*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range dirs {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.vm"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sources []string
+		for _, path := range paths {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sources = append(sources, path, string(b))
+		}
+		m, err := vm.New(parse(t, sources...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry := ""
+		if m.Defines("Sys.init") {
+			entry = "Sys.init"
+		}
+		report, err := AnalyzeStack(parse(t, sources...), entry)
+		if err != nil {
+			t.Errorf("%s: %v", dir, err)
+			continue
+		}
+		if report.Total > StackLimit {
+			t.Errorf("%s: got: %d words wanted: at most %d", dir, report.Total, StackLimit)
+		}
+
+		// started from Sys.init, the interpreter must not take the stack deeper than computed
+		if report.Total == Unbounded || entry == "" {
+			continue
+		}
+		if err := m.Bootstrap(entry); err != nil {
+			t.Fatal(err)
+		}
+		deepest := 0
+		for !m.Halted() && m.Steps < 10000 {
+			if err := m.Step(); err != nil {
+				t.Fatalf("%s: %v", dir, err)
+			}
+			if d := int(m.Peek(vm.SP)) - vm.StackBase; d > deepest {
+				deepest = d
+			}
+		}
+		if deepest > report.Total {
+			t.Errorf("%s: got: %d words used wanted: at most %d", dir, deepest, report.Total)
+		}
+	}
+}
@@ -1,101 +1,551 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 
+	"github.com/sato11/the-hack-vm-translator/assembler"
 	"github.com/sato11/the-hack-vm-translator/codewriter"
+	"github.com/sato11/the-hack-vm-translator/linker"
+	"github.com/sato11/the-hack-vm-translator/optimizer"
 	"github.com/sato11/the-hack-vm-translator/parser"
 )
 
-// ExitCodeOK and ExitCodeError represent respectively a status code.
+// ExitCodeOK, ExitCodeError and ExitCodeUsage represent respectively a status code.
 const (
 	ExitCodeOK int = iota
 	ExitCodeError
+	ExitCodeUsage
 )
 
-func translateFile(path string, w *codewriter.CodeWriter) error {
+// name is the name of the command shown in messages.
+const name = "the-hack-vm-translator"
+
+// version is the version of the translator printed by -version.
+const version = "0.2.0"
+
+// entryUsage is the help text of the -entry flag of both the translator and the run command.
+const entryUsage = "the `function` the bootstrap code calls"
+
+const usage = `Usage: %s [flags] path...
+       %[1]s run [flags] path...
+
+Translates programs written in VM code into Hack assembly.
+Each path is either a .vm file or a directory holding the .vm files of a program,
+and is translated into a .asm file of its own, or a .hack file with -format hack. Only the .vm files directly inside
+a directory are translated unless -r is given, and they are linked in lexical
+order of their paths. With -link, all of the paths make up a single program whose
+files are linked in the order the paths are given.
+
+Bootstrap code calling the entry point, Sys.init unless -entry is given, is emitted
+only if the program defines it, unless told otherwise.
+
+The run command executes the program made of all of the paths with the VM interpreter
+instead of translating it. Run '%[1]s run -h' for its flags.
+
+Flags:
+`
+
+// options holds the settings given on the command line.
+type options struct {
+	output     string
+	bootstrap  codewriter.Bootstrap
+	stdout     bool
+	verbose    bool
+	recursive  bool
+	link       bool
+	format     string
+	shared     bool
+	optimize   bool
+	optimizeVM bool
+	check      bool
+	shake      bool
+	stack      bool
+	entry      string
+	report     bool
+	// log, if not nil, receives the functions left out by -shake
+	// and the number of commands the optimizer eliminated.
+	log io.Writer
+}
+
+// parseFile reads and parses the .vm file at path.
+func parseFile(path string) (*parser.File, error) {
 	f, err := os.Open(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer f.Close()
 
-	p := parser.New(f)
-	for p.HasMoreCommands() {
-		p.Advance()
-		switch p.CommandType() {
-		case parser.ArithmeticCommand:
-			w.WriteArithmetic(p.Command())
-		case parser.PushCommand, parser.PopCommand:
-			index, err := strconv.Atoi(p.Arg2())
+	return parser.ParseFile(path, f)
+}
+
+// parseFiles parses every file in paths, collecting the errors of all of them.
+func parseFiles(paths []string) ([]*parser.File, parser.ErrorList) {
+	var files []*parser.File
+	var errs parser.ErrorList
+	for _, path := range paths {
+		file, err := parseFile(path)
+		if list, ok := err.(parser.ErrorList); ok {
+			errs = append(errs, list...)
+		} else if err != nil {
+			errs.Add(parser.Position{}, err)
+			continue
+		}
+		files = append(files, file)
+	}
+	return files, errs
+}
+
+// sourceFiles returns the .vm files making up the program at path:
+// path itself when it is a .vm file, otherwise the .vm files directly inside the directory path,
+// or anywhere under it when recursive is set. Files of a directory are returned in lexical order.
+func sourceFiles(path string, recursive bool) ([]string, error) {
+	if filepath.Ext(path) == ".vm" {
+		return []string{path}, nil
+	}
+
+	var paths []string
+	if recursive {
+		err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
-			w.WritePushPop(p.CommandType(), p.Arg1(), index)
-		case parser.LabelCommand:
-			w.WriteLabel(p.Arg1())
-		case parser.GotoCommand:
-			w.WriteGoto(p.Arg1())
-		case parser.IfCommand:
-			w.WriteIf(p.Arg1())
-		case parser.CallCommand:
-			numArgs, err := strconv.Atoi(p.Arg2())
-			if err != nil {
-				return err
+			if !info.IsDir() && filepath.Ext(path) == ".vm" {
+				paths = append(paths, path)
 			}
-			w.WriteCall(p.Arg1(), numArgs)
-		case parser.ReturnCommand:
-			w.WriteReturn()
-		case parser.FunctionCommand:
-			numLocals, err := strconv.Atoi(p.Arg2())
-			if err != nil {
-				return err
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		infos, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if !info.IsDir() && filepath.Ext(info.Name()) == ".vm" {
+				paths = append(paths, filepath.Join(path, info.Name()))
 			}
-			w.WriteFunction(p.Arg1(), numLocals)
 		}
 	}
 
-	return nil
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%s: no .vm files found", path)
+	}
+	return paths, nil
 }
 
-// main reads single file when argument is vm file.
-// otherwise recursively searches for vm files under the given path.
-func main() {
-	path := os.Args[1]
-	codewriter := codewriter.New()
-	codewriter.Setup()
+// programFiles returns the .vm files of the program made of inputs, in the order they are linked.
+// Each file must be given once, and no two files may share a namespace.
+func programFiles(inputs []string, recursive bool) ([]string, error) {
+	var paths []string
+	namespaces := make(map[string]string)
+	for _, input := range inputs {
+		files, err := sourceFiles(input, recursive)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range files {
+			namespace := strings.TrimSuffix(filepath.Base(path), ".vm")
+			if other, ok := namespaces[namespace]; ok {
+				if filepath.Clean(other) == filepath.Clean(path) {
+					return nil, fmt.Errorf("%s: given more than once", path)
+				}
+				return nil, fmt.Errorf("%s and %s cannot be linked together as both define the namespace %s", other, path, namespace)
+			}
+			namespaces[namespace] = path
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
 
-	extension := filepath.Ext(path)
+// outputPath returns the path of the file with the given extension the program at path is written to.
+// A .vm file is written next to itself, e.g. dir/Main.vm to dir/Main.asm,
+// while a directory is written inside itself after its own name, e.g. dir/Prog to dir/Prog/Prog.asm.
+func outputPath(path, extension string) (string, error) {
+	if filepath.Ext(path) == ".vm" {
+		return fmt.Sprintf("%s%s", strings.TrimSuffix(path, ".vm"), extension), nil
+	}
 
-	if extension == ".vm" {
-		codewriter.SetFileName(fmt.Sprintf("%s.asm", strings.TrimSuffix(path, extension)))
-		err := translateFile(path, codewriter)
+	dir := filepath.Clean(path)
+	base := filepath.Base(dir)
+	if base == "." || base == ".." {
+		abs, err := filepath.Abs(dir)
 		if err != nil {
-			fmt.Println(err.Error())
-			os.Exit(ExitCodeError)
+			return "", err
 		}
-	} else {
-		filename := filepath.Join(fmt.Sprintf("%s", path), fmt.Sprintf("%s.asm", path))
-		codewriter.SetFileName(filename)
-		err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
-			if filepath.Ext(path) == ".vm" {
-				codewriter.SetNamespace(strings.TrimSuffix(filepath.Base(path), ".vm"))
-				err := translateFile(path, codewriter)
-				if err != nil {
-					fmt.Println(err.Error())
-					os.Exit(ExitCodeError)
-				}
+		base = filepath.Base(abs)
+	}
+	if base == string(filepath.Separator) || base == "." {
+		return "", fmt.Errorf("%s: cannot name output after the directory, use -o", path)
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s%s", base, extension)), nil
+}
+
+// loadProgram parses and validates every file in paths, collecting the errors of all of them.
+func loadProgram(paths []string) ([]*parser.File, error) {
+	files, errs := parseFiles(paths)
+	if err, ok := parser.Validate(files).(parser.ErrorList); ok {
+		errs = append(errs, err...)
+	}
+	if err, ok := linker.CheckSymbols(files).(parser.ErrorList); ok {
+		errs = append(errs, err...)
+	}
+	if len(errs) != 0 {
+		errs.Sort()
+		return nil, errs
+	}
+	return files, nil
+}
+
+// translate parses and validates every file in paths, checks them as a whole, leaves out unreachable functions
+// and optimizes them if asked to, then writes them as a single program into w.
+// Nothing is written unless all of the files are valid.
+func translate(paths []string, w *codewriter.CodeWriter, opts options) error {
+	files, err := loadProgram(paths)
+	if err != nil {
+		return err
+	}
+
+	if opts.check {
+		entry := opts.entry
+		if opts.bootstrap == codewriter.BootstrapNever {
+			entry = ""
+		}
+		if err := linker.Check(files, entry); err != nil {
+			return err
+		}
+	}
+	if opts.shake {
+		var dropped []linker.Function
+		files, dropped, err = linker.Shake(files, opts.entry)
+		if err != nil {
+			return err
+		}
+		if opts.bootstrap == codewriter.BootstrapAlways && !linker.Reachable(files, opts.entry)[opts.entry] {
+			return fmt.Errorf("bootstrap: entry point %s is not defined", opts.entry)
+		}
+		if opts.log != nil {
+			for _, f := range dropped {
+				fmt.Fprintf(opts.log, "dropped %s at %s (%d commands)\n", f.Name, f.Pos, f.Commands)
 			}
-			return nil
-		})
+		}
+	}
+	if opts.optimizeVM {
+		var stats optimizer.Stats
+		files, stats = optimizer.Optimize(files)
+		if opts.log != nil {
+			fmt.Fprintf(opts.log, "optimized: %s\n", stats)
+		}
+	}
+
+	w.SetEntry(opts.entry)
+	w.SetSharedRoutines(opts.shared)
+	w.SetOptimize(opts.optimize)
+	return w.WriteProgram(files, opts.bootstrap)
+}
+
+// romSize is the number of instructions the instruction memory of the Hack computer holds.
+const romSize = assembler.MaxAddress + 1
+
+// sizeReport writes to w the number of instructions of the program made of paths,
+// translated with inline code and with shared routines.
+func sizeReport(name string, paths []string, opts options, w io.Writer) error {
+	var sizes [2]int
+	for i, shared := range []bool{false, true} {
+		opts.shared = shared
+		var asm bytes.Buffer
+		cw := codewriter.NewWriter(&asm)
+		if err := translate(paths, cw, opts); err != nil {
+			return err
+		}
+		if err := cw.Flush(); err != nil {
+			return err
+		}
+		// every line of the translation is an instruction or a label
+		sizes[i] = strings.Count(asm.String(), "\n") - strings.Count(asm.String(), "(")
+	}
+
+	fmt.Fprintf(w, "%s:\n", name)
+	for i, mode := range []string{"inline", "shared"} {
+		fmt.Fprintf(w, "  %s: %d instructions", mode, sizes[i])
+		if sizes[i] > romSize {
+			fmt.Fprintf(w, " (exceeds the ROM of %d instructions)", romSize)
+		}
+		fmt.Fprintln(w)
+	}
+	if sizes[0] > 0 {
+		fmt.Fprintf(w, "  shared routines save %d instructions (%.1f%%)\n", sizes[0]-sizes[1], 100*float64(sizes[0]-sizes[1])/float64(sizes[0]))
+	}
+	return nil
+}
+
+// stackReport writes to w how deep the stack of the program made of paths may grow,
+// by function and as a whole.
+func stackReport(name string, paths []string, opts options, w io.Writer) error {
+	files, err := loadProgram(paths)
+	if err != nil {
+		return err
+	}
+	report, err := linker.AnalyzeStack(files, opts.entry)
+	if err != nil {
+		return err
+	}
+
+	words := func(n int) string {
+		if n == linker.Unbounded {
+			return "unbounded"
+		}
+		return plural(n, "word")
+	}
+	fmt.Fprintf(w, "%s:\n", name)
+	for _, code := range report.Code {
+		fmt.Fprintf(w, "  %s: %s, at most %s, %s at worst\n", code.Name, plural(code.Locals, "local"), plural(code.Max, "value"), words(code.Total))
+	}
+	fmt.Fprintf(w, "  stack: %s of %d", words(report.Total), linker.StackLimit)
+	if report.Total > linker.StackLimit {
+		fmt.Fprint(w, " (overflows into the heap)")
+	}
+	fmt.Fprintln(w)
+	return nil
+}
+
+// plural returns n followed by noun, in the plural unless n is 1.
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// translateProgram translates the program made of inputs according to opts.
+func translateProgram(inputs []string, opts options, stdout, stderr io.Writer) error {
+	paths, err := programFiles(inputs, opts.recursive)
+	if err != nil {
+		return err
+	}
+
+	if opts.verbose {
+		for _, path := range paths {
+			fmt.Fprintf(stderr, "translating %s\n", path)
+		}
+	}
+
+	if opts.report {
+		if err := sizeReport(inputs[0], paths, opts, stderr); err != nil {
+			return err
+		}
+	}
+	if opts.stack {
+		if err := stackReport(inputs[0], paths, opts, stderr); err != nil {
+			return err
+		}
+	}
+	if opts.verbose || opts.report {
+		opts.log = stderr
+	}
+
+	if opts.format == "hack" {
+		return assembleProgram(inputs, paths, opts, stdout, stderr)
+	}
+
+	if opts.stdout {
+		w := codewriter.NewWriter(stdout)
+		if err := translate(paths, w, opts); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+
+	output := opts.output
+	if output == "" {
+		output, err = outputPath(inputs[0], ".asm")
 		if err != nil {
-			os.Exit(ExitCodeError)
+			return err
 		}
 	}
 
-	codewriter.Save()
-	os.Exit(ExitCodeOK)
+	w := codewriter.New()
+	w.SetFileName(output)
+	if err := translate(paths, w, opts); err != nil {
+		return err
+	}
+	if err := w.Save(); err != nil {
+		return err
+	}
+
+	if opts.verbose {
+		fmt.Fprintf(stderr, "wrote %s\n", output)
+	}
+	return nil
+}
+
+// assembleProgram translates the .vm files in paths, which make up the program given by inputs,
+// into Hack machine code according to opts.
+func assembleProgram(inputs, paths []string, opts options, stdout, stderr io.Writer) error {
+	var asm bytes.Buffer
+	w := codewriter.NewWriter(&asm)
+	if err := translate(paths, w, opts); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	program, err := assembler.Assemble("", &asm)
+	if err != nil {
+		return err
+	}
+
+	if opts.stdout {
+		return program.WriteHack(stdout)
+	}
+
+	output := opts.output
+	if output == "" {
+		output, err = outputPath(inputs[0], ".hack")
+		if err != nil {
+			return err
+		}
+	}
+
+	var hack bytes.Buffer
+	if err := program.WriteHack(&hack); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(output, hack.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	if opts.verbose {
+		fmt.Fprintf(stderr, "wrote %s\n", output)
+	}
+	return nil
+}
+
+// usageError reports a misuse of the command on stderr and returns ExitCodeUsage.
+func usageError(stderr io.Writer, format string, a ...interface{}) int {
+	fmt.Fprintf(stderr, "%s: %s\n", name, fmt.Sprintf(format, a...))
+	fmt.Fprintf(stderr, "Run '%s -h' for usage.\n", name)
+	return ExitCodeUsage
+}
+
+// bootstrapMode returns the bootstrap mode selected by the -bootstrap and -no-bootstrap flags,
+// where -bootstrap=false stands for -no-bootstrap.
+func bootstrapMode(flags *flag.FlagSet, bootstrap, noBootstrap bool) (codewriter.Bootstrap, error) {
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "bootstrap" && !bootstrap {
+			noBootstrap = true
+		}
+	})
+	switch {
+	case bootstrap && noBootstrap:
+		return 0, errors.New("-bootstrap and -no-bootstrap cannot be used together")
+	case bootstrap:
+		return codewriter.BootstrapAlways, nil
+	case noBootstrap:
+		return codewriter.BootstrapNever, nil
+	default:
+		return codewriter.BootstrapAuto, nil
+	}
+}
+
+// run executes the translator with the command-line arguments args and returns its exit code.
+// If the first argument is run, the program is executed by the VM interpreter instead.
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) != 0 && args[0] == "run" {
+		return interpret(args[1:], stdout, stderr)
+	}
+
+	var opts options
+	var bootstrap, noBootstrap, showVersion bool
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, usage, name)
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&opts.output, "o", "", "write the output to `file` instead of next to the input")
+	flags.BoolVar(&bootstrap, "bootstrap", false, "always emit bootstrap code which calls the entry point (-entry)\n(by default it is emitted only if the entry point is defined)")
+	flags.BoolVar(&noBootstrap, "no-bootstrap", false, "never emit bootstrap code")
+	flags.BoolVar(&opts.stdout, "stdout", false, "write the output to standard output")
+	flags.StringVar(&opts.format, "format", "asm", "output `format`: asm for Hack assembly or hack for Hack machine code")
+	flags.BoolVar(&opts.recursive, "r", false, "also translate the .vm files in subdirectories of a directory")
+	flags.BoolVar(&opts.link, "link", false, "link all of the paths into a single program, in the order they are given")
+	flags.BoolVar(&opts.shared, "shared", false, "jump to routines shared by the whole program for call, return, eq, gt and lt\ninstead of expanding them inline, which makes the output much smaller")
+	flags.BoolVar(&opts.optimize, "O", false, "remove waste from the output, such as pushes immediately popped")
+	flags.BoolVar(&opts.optimizeVM, "Ovm", false, "optimize the VM code before translating it: fold constant arithmetic,\nremove unreachable code, unused labels and jumps to the next command")
+	flags.BoolVar(&opts.check, "check", false, "check the calls across files: undefined or duplicate functions, functions outside\nof their file's namespace, inconsistent argument counts and a missing entry point")
+	flags.BoolVar(&opts.shake, "shake", false, "leave out the functions which cannot be reached from the entry point")
+	flags.BoolVar(&opts.stack, "stack", false, "check that every function keeps the stack consistent and report on standard error\nhow deep the stack may grow, by function and as a whole")
+	flags.StringVar(&opts.entry, "entry", "Sys.init", entryUsage+", from which -check, -shake and -stack start too")
+	flags.BoolVar(&opts.report, "report", false, "report on standard error the size of the output with and without -shared")
+	flags.BoolVar(&opts.verbose, "v", false, "report the files being translated on standard error")
+	flags.BoolVar(&showVersion, "version", false, "print the version and exit")
+
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitCodeOK
+		}
+		return ExitCodeUsage
+	}
+
+	if showVersion {
+		fmt.Fprintf(stdout, "%s version %s\n", name, version)
+		return ExitCodeOK
+	}
+
+	misuse := func(format string, a ...interface{}) int {
+		return usageError(stderr, format, a...)
+	}
+
+	inputs := flags.Args()
+	switch {
+	case len(inputs) == 0:
+		return misuse("no input path given")
+	case opts.format != "asm" && opts.format != "hack":
+		return misuse("unknown format %q: must be asm or hack", opts.format)
+	case opts.output != "" && opts.stdout:
+		return misuse("-o and -stdout cannot be used together")
+	case opts.output != "" && len(inputs) > 1 && !opts.link:
+		return misuse("-o cannot be used with more than one input path unless -link is given")
+	case opts.link && len(inputs) > 1 && opts.output == "" && !opts.stdout:
+		return misuse("-link requires -o or -stdout when more than one input path is given")
+	}
+
+	var err error
+	if opts.bootstrap, err = bootstrapMode(flags, bootstrap, noBootstrap); err != nil {
+		return misuse("%v", err)
+	}
+
+	programs := [][]string{inputs}
+	if !opts.link {
+		programs = nil
+		for _, input := range inputs {
+			programs = append(programs, []string{input})
+		}
+	}
+
+	status := ExitCodeOK
+	for _, program := range programs {
+		if err := translateProgram(program, opts, stdout, stderr); err != nil {
+			fmt.Fprintln(stderr, err.Error())
+			status = ExitCodeError
+		}
+	}
+	return status
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
 }
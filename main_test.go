@@ -0,0 +1,640 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type runTest struct {
+	args   []string
+	status int
+	stdout string
+	stderr string
+}
+
+func TestRunUsage(t *testing.T) {
+	tests := []runTest{
+		{[]string{}, ExitCodeUsage, "", "no input path given"},
+		{[]string{"-h"}, ExitCodeOK, "", "Usage:"},
+		{[]string{"-version"}, ExitCodeOK, "version " + version, ""},
+		{[]string{"-unknown", "Main.vm"}, ExitCodeUsage, "", "flag provided but not defined"},
+		{[]string{"-format", "bin", "Main.vm"}, ExitCodeUsage, "", `unknown format "bin"`},
+		{[]string{"-o", "Out.asm", "-stdout", "Main.vm"}, ExitCodeUsage, "", "-o and -stdout cannot be used together"},
+		{[]string{"-o", "Out.asm", "A.vm", "B.vm"}, ExitCodeUsage, "", "-o cannot be used with more than one input path unless -link is given"},
+		{[]string{"-bootstrap", "-no-bootstrap", "Main.vm"}, ExitCodeUsage, "", "-bootstrap and -no-bootstrap cannot be used together"},
+		{[]string{filepath.Join("testdata", "Missing.vm")}, ExitCodeError, "", "no such file or directory"},
+	}
+
+	for i, test := range tests {
+		var stdout, stderr bytes.Buffer
+		status := run(test.args, &stdout, &stderr)
+		if status != test.status {
+			t.Errorf("#%d: got: %v wanted: %v", i, status, test.status)
+		}
+		if !strings.Contains(stdout.String(), test.stdout) {
+			t.Errorf("#%d: got: %v wanted: %v", i, stdout.String(), test.stdout)
+		}
+		if !strings.Contains(stderr.String(), test.stderr) {
+			t.Errorf("#%d: got: %v wanted: %v", i, stderr.String(), test.stderr)
+		}
+	}
+}
+
+func TestRunStdout(t *testing.T) {
+	path := filepath.Join("testdata", "StackArithmetic", "SimpleAdd", "SimpleAdd.vm")
+
+	var stdout, stderr bytes.Buffer
+	if status := run([]string{"-stdout", path}, &stdout, &stderr); status != ExitCodeOK {
+		t.Fatalf("got: %v wanted: %v: %v", status, ExitCodeOK, stderr.String())
+	}
+	if !strings.HasPrefix(stdout.String(), "@7\n") {
+		t.Errorf("got: %v wanted: output starting with @7", stdout.String())
+	}
+}
+
+type bootstrapTest struct {
+	args      []string
+	path      string
+	bootstrap bool
+}
+
+func TestRunBootstrap(t *testing.T) {
+	simpleAdd := filepath.Join("testdata", "StackArithmetic", "SimpleAdd", "SimpleAdd.vm")
+	nestedCall := filepath.Join("testdata", "FunctionCalls", "NestedCall", "Sys.vm")
+	tests := []bootstrapTest{
+		{[]string{}, simpleAdd, false},
+		{[]string{}, nestedCall, true},
+		{[]string{"-bootstrap"}, simpleAdd, true},
+		{[]string{"-bootstrap=true"}, nestedCall, true},
+		{[]string{"-no-bootstrap"}, nestedCall, false},
+		{[]string{"-bootstrap=false"}, nestedCall, false},
+	}
+
+	for i, test := range tests {
+		var stdout, stderr bytes.Buffer
+		args := append(append([]string{"-stdout"}, test.args...), test.path)
+		if status := run(args, &stdout, &stderr); status != ExitCodeOK {
+			t.Fatalf("#%d: got: %v wanted: %v: %v", i, status, ExitCodeOK, stderr.String())
+		}
+		if strings.HasPrefix(stdout.String(), "@256\n") != test.bootstrap {
+			t.Errorf("#%d: got: %v wanted: bootstrap %v", i, stdout.String()[:10], test.bootstrap)
+		}
+	}
+}
+
+func TestRunOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "translator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "Main.vm")
+	if err := ioutil.WriteFile(source, []byte("push constant 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	invalid := filepath.Join(dir, "Invalid.vm")
+	if err := ioutil.WriteFile(invalid, []byte("pop constant 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	output := filepath.Join(dir, "Out.asm")
+	if status := run([]string{"-v", "-o", output, source}, &stdout, &stderr); status != ExitCodeOK {
+		t.Fatalf("got: %v wanted: %v: %v", status, ExitCodeOK, stderr.String())
+	}
+	if _, err := os.Stat(output); err != nil {
+		t.Errorf("got: %v wanted: %v to exist", err, output)
+	}
+	if !strings.Contains(stderr.String(), "wrote "+output) {
+		t.Errorf("got: %v wanted: %v", stderr.String(), "wrote "+output)
+	}
+
+	stderr.Reset()
+	if status := run([]string{source, invalid}, &stdout, &stderr); status != ExitCodeError {
+		t.Errorf("got: %v wanted: %v", status, ExitCodeError)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Main.asm")); err != nil {
+		t.Errorf("got: %v wanted: Main.asm to exist", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Invalid.asm")); !os.IsNotExist(err) {
+		t.Errorf("got: %v wanted: Invalid.asm not to exist", err)
+	}
+	if !strings.Contains(stderr.String(), "Invalid.vm:1:1: pop: cannot pop into the constant segment") {
+		t.Errorf("got: %v wanted: position of the invalid command", stderr.String())
+	}
+}
+
+type outputPathTest struct {
+	path   string
+	output string
+}
+
+func TestOutputPath(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cwd := filepath.Base(wd)
+	parent := filepath.Base(filepath.Dir(wd))
+	nestedCall := filepath.Join("testdata", "FunctionCalls", "NestedCall")
+	sep := string(filepath.Separator)
+
+	tests := []outputPathTest{
+		{"Main.vm", "Main.asm"},
+		{filepath.Join("dir", "Main.vm"), filepath.Join("dir", "Main.asm")},
+		{nestedCall, filepath.Join(nestedCall, "NestedCall.asm")},
+		{nestedCall + sep, filepath.Join(nestedCall, "NestedCall.asm")},
+		{"." + sep + nestedCall, filepath.Join(nestedCall, "NestedCall.asm")},
+		{filepath.Join(wd, nestedCall), filepath.Join(wd, nestedCall, "NestedCall.asm")},
+		{filepath.Join(wd, nestedCall) + sep, filepath.Join(wd, nestedCall, "NestedCall.asm")},
+		{"NestedCall", filepath.Join("NestedCall", "NestedCall.asm")},
+		{".", cwd + ".asm"},
+		{"." + sep, cwd + ".asm"},
+		{"..", filepath.Join("..", parent+".asm")},
+		{filepath.Join(nestedCall, ".."), filepath.Join("testdata", "FunctionCalls", "FunctionCalls.asm")},
+	}
+
+	for i, test := range tests {
+		output, err := outputPath(test.path, ".asm")
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		} else if output != test.output {
+			t.Errorf("#%d: got: %v wanted: %v", i, output, test.output)
+		}
+	}
+
+	if _, err := outputPath(sep, ".asm"); err == nil {
+		t.Errorf("got: nil wanted: error for the root directory")
+	}
+}
+
+func TestRunDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "translator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	program := filepath.Join(dir, "Program")
+	if err := os.Mkdir(program, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(program, "Sys.vm"), []byte("function Sys.init 0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if status := run([]string{program + string(filepath.Separator)}, &stdout, &stderr); status != ExitCodeOK {
+		t.Fatalf("got: %v wanted: %v: %v", status, ExitCodeOK, stderr.String())
+	}
+	if _, err := os.Stat(filepath.Join(program, "Program.asm")); err != nil {
+		t.Errorf("got: %v wanted: Program.asm to exist", err)
+	}
+}
+
+// writeFiles creates the files under dir with the given contents.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type sourceFilesTest struct {
+	path      string
+	recursive bool
+	paths     []string
+}
+
+func TestSourceFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "translator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"Sys.vm":           "",
+		"Main.vm":          "",
+		"Main.asm":         "",
+		"lib/Math.vm":      "",
+		"lib/deep/Util.vm": "",
+		"empty/README":     "",
+	})
+
+	tests := []sourceFilesTest{
+		{filepath.Join(dir, "Main.vm"), false, []string{"Main.vm"}},
+		{dir, false, []string{"Main.vm", "Sys.vm"}},
+		{dir, true, []string{"Main.vm", "Sys.vm", "lib/Math.vm", "lib/deep/Util.vm"}},
+		{filepath.Join(dir, "lib"), false, []string{"lib/Math.vm"}},
+	}
+
+	for i, test := range tests {
+		paths, err := sourceFiles(test.path, test.recursive)
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		var expected []string
+		for _, path := range test.paths {
+			expected = append(expected, filepath.Join(dir, filepath.FromSlash(path)))
+		}
+		if strings.Join(paths, ",") != strings.Join(expected, ",") {
+			t.Errorf("#%d: got: %v wanted: %v", i, paths, expected)
+		}
+	}
+
+	if _, err := sourceFiles(filepath.Join(dir, "empty"), true); err == nil {
+		t.Errorf("got: nil wanted: error for a directory without .vm files")
+	}
+}
+
+func TestProgramFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "translator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"Sys.vm":      "",
+		"Main.vm":     "",
+		"lib/Math.vm": "",
+		"lib/Main.vm": "",
+	})
+	sys := filepath.Join(dir, "Sys.vm")
+	main := filepath.Join(dir, "Main.vm")
+	math := filepath.Join(dir, "lib", "Math.vm")
+
+	paths, err := programFiles([]string{sys, math, main}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Join(paths, ",") != strings.Join([]string{sys, math, main}, ",") {
+		t.Errorf("got: %v wanted: %v", paths, []string{sys, math, main})
+	}
+
+	if _, err := programFiles([]string{sys, sys}, false); err == nil || !strings.Contains(err.Error(), "given more than once") {
+		t.Errorf("got: %v wanted: error for a file given twice", err)
+	}
+	if _, err := programFiles([]string{dir}, true); err == nil || !strings.Contains(err.Error(), "namespace Main") {
+		t.Errorf("got: %v wanted: error for files sharing a namespace", err)
+	}
+}
+
+func TestRunLink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "translator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"A.vm": "push constant 1\n",
+		"B.vm": "push constant 2\n",
+	})
+	a := filepath.Join(dir, "A.vm")
+	b := filepath.Join(dir, "B.vm")
+
+	var stdout, stderr bytes.Buffer
+	if status := run([]string{"-link", "-stdout", b, a}, &stdout, &stderr); status != ExitCodeOK {
+		t.Fatalf("got: %v wanted: %v: %v", status, ExitCodeOK, stderr.String())
+	}
+	if !strings.HasPrefix(stdout.String(), "@2\n") || !strings.Contains(stdout.String(), "@1\n") {
+		t.Errorf("got: %v wanted: B.vm linked before A.vm", stdout.String())
+	}
+
+	if status := run([]string{"-link", b, a}, &stdout, &stderr); status != ExitCodeUsage {
+		t.Errorf("got: %v wanted: %v", status, ExitCodeUsage)
+	}
+
+	output := filepath.Join(dir, "Linked.asm")
+	if status := run([]string{"-link", "-o", output, b, a}, &stdout, &stderr); status != ExitCodeOK {
+		t.Fatalf("got: %v wanted: %v: %v", status, ExitCodeOK, stderr.String())
+	}
+	if _, err := os.Stat(output); err != nil {
+		t.Errorf("got: %v wanted: %v to exist", err, output)
+	}
+}
+
+func TestRunHack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "translator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"Program/Sys.vm":  "function Sys.init 0\ncall Main.main 0\nlabel WHILE\ngoto WHILE\n",
+		"Program/Main.vm": "function Main.main 0\npush constant 7\nreturn\n",
+	})
+	program := filepath.Join(dir, "Program")
+
+	var stdout, stderr bytes.Buffer
+	if status := run([]string{"-format", "hack", program}, &stdout, &stderr); status != ExitCodeOK {
+		t.Fatalf("got: %v wanted: %v: %v", status, ExitCodeOK, stderr.String())
+	}
+	b, err := ioutil.ReadFile(filepath.Join(program, "Program.hack"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if lines[0] != "0000000100000000" {
+		t.Errorf("got: %v wanted: %v", lines[0], "0000000100000000")
+	}
+	for i, line := range lines {
+		if len(line) != 16 || strings.Trim(line, "01") != "" {
+			t.Errorf("#%d: got: %q wanted: 16 binary digits", i, line)
+		}
+	}
+
+	stdout.Reset()
+	if status := run([]string{"-format", "hack", "-stdout", program}, &stdout, &stderr); status != ExitCodeOK {
+		t.Fatalf("got: %v wanted: %v: %v", status, ExitCodeOK, stderr.String())
+	}
+	if stdout.String() != string(b) {
+		t.Errorf("got: %v wanted: %v", stdout.String(), string(b))
+	}
+}
+
+func TestRunInterpreter(t *testing.T) {
+	simpleAdd := filepath.Join("testdata", "StackArithmetic", "SimpleAdd", "SimpleAdd.vm")
+	nestedCall := filepath.Join("testdata", "FunctionCalls", "NestedCall")
+	statics := filepath.Join("testdata", "FunctionCalls", "StaticsTest")
+	tests := []runTest{
+		{[]string{"run"}, ExitCodeUsage, "", "no input path given"},
+		{[]string{"run", "-h"}, ExitCodeOK, "", "Usage:"},
+		{[]string{"run", "-limit", "0", simpleAdd}, ExitCodeUsage, "", "-limit must be positive"},
+		{[]string{"run", "-bootstrap", "-no-bootstrap", simpleAdd}, ExitCodeUsage, "", "-bootstrap and -no-bootstrap cannot be used together"},
+		{[]string{"run", simpleAdd}, ExitCodeOK, "halted after 3 steps\nstack: 15\n", ""},
+		{[]string{"run", "-trace", simpleAdd}, ExitCodeOK, "stack: 15\n", simpleAdd + ":7:1: push constant 7\n"},
+		{[]string{"run", "-bootstrap", simpleAdd}, ExitCodeError, "", "call to undefined function Sys.init"},
+		{[]string{"run", "-bootstrap", "-entry", "Sys.main", simpleAdd}, ExitCodeError, "", "call to undefined function Sys.main"},
+		{[]string{"run", "-entry", "Sys.main", nestedCall}, ExitCodeOK, "halted after 33 steps\nstack: 246\n", ""},
+		{[]string{"run", nestedCall}, ExitCodeOK, "halted after 42 steps\nstack: 42 0 0 0 0\n", ""},
+		{[]string{"run", "-limit", "10", nestedCall}, ExitCodeError, "", "did not halt within 10 steps"},
+		{[]string{"run", statics}, ExitCodeOK, "stack: 37 0 0 0 0 -2 8\n", ""},
+		{[]string{"run", "-break", "Class1.get", statics}, ExitCodeOK, "break at " + filepath.Join(statics, "Class1.vm") + ":16:1: function Class1.get 0\nstack: 37 0 0 0 0 34 261 256 0 0\n", ""},
+		{[]string{"run", "-break", "Sys.vm:17", statics}, ExitCodeOK, "Sys.vm:17:1: call Class1.get 0\nstack: 37 0 0 0 0\n", ""},
+		{[]string{"run", "-break", "Main.vm:1", statics}, ExitCodeError, "", "Main.vm is not part of the program"},
+		{[]string{"run", "-break", "Main.main", statics}, ExitCodeError, "", "call to undefined function Main.main"},
+	}
+
+	for i, test := range tests {
+		var stdout, stderr bytes.Buffer
+		status := run(test.args, &stdout, &stderr)
+		if status != test.status {
+			t.Errorf("#%d: got: %v wanted: %v: %v", i, status, test.status, stderr.String())
+		}
+		if !strings.Contains(stdout.String(), test.stdout) {
+			t.Errorf("#%d: got: %v wanted: %v", i, stdout.String(), test.stdout)
+		}
+		if !strings.Contains(stderr.String(), test.stderr) {
+			t.Errorf("#%d: got: %v wanted: %v", i, stderr.String(), test.stderr)
+		}
+	}
+}
+
+func TestRunShared(t *testing.T) {
+	fibonacci := filepath.Join("testdata", "FunctionCalls", "FibonacciElement")
+
+	var inline, shared, stderr bytes.Buffer
+	if status := run([]string{"-stdout", fibonacci}, &inline, &stderr); status != ExitCodeOK {
+		t.Fatalf("got: %v wanted: %v: %v", status, ExitCodeOK, stderr.String())
+	}
+	if status := run([]string{"-stdout", "-shared", fibonacci}, &shared, &stderr); status != ExitCodeOK {
+		t.Fatalf("got: %v wanted: %v: %v", status, ExitCodeOK, stderr.String())
+	}
+	if !strings.Contains(shared.String(), "($$CALL)") || strings.Contains(inline.String(), "($$CALL)") {
+		t.Errorf("-shared does not select the shared call routine")
+	}
+	if shared.Len() >= inline.Len() {
+		t.Errorf("got: %d bytes with -shared wanted: less than %d", shared.Len(), inline.Len())
+	}
+}
+
+func TestRunOptimize(t *testing.T) {
+	fibonacci := filepath.Join("testdata", "FunctionCalls", "FibonacciElement")
+
+	var plain, optimized, stderr bytes.Buffer
+	if status := run([]string{"-stdout", fibonacci}, &plain, &stderr); status != ExitCodeOK {
+		t.Fatalf("got: %v wanted: %v: %v", status, ExitCodeOK, stderr.String())
+	}
+	if status := run([]string{"-stdout", "-O", fibonacci}, &optimized, &stderr); status != ExitCodeOK {
+		t.Fatalf("got: %v wanted: %v: %v", status, ExitCodeOK, stderr.String())
+	}
+	if optimized.Len() >= plain.Len() {
+		t.Errorf("got: %d bytes with -O wanted: less than %d", optimized.Len(), plain.Len())
+	}
+}
+
+func TestRunOptimizeReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "optimize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"Main.vm": "push constant 3\npush constant 4\nadd\ngoto END\npop temp 0\nlabel END\ngoto END\n",
+	})
+	source := filepath.Join(dir, "Main.vm")
+
+	var stdout, stderr bytes.Buffer
+	if status := run([]string{"-v", "-Ovm", "-stdout", source}, &stdout, &stderr); status != ExitCodeOK {
+		t.Fatalf("got: %v wanted: %v: %v", status, ExitCodeOK, stderr.String())
+	}
+	want := "optimized: 4 of 7 commands eliminated: 2 folded, 1 unreachable, 0 unused labels, 1 jumps to the next command\n"
+	if !strings.Contains(stderr.String(), want) {
+		t.Errorf("got: %v wanted: %v", stderr.String(), want)
+	}
+
+	// -O alone leaves the VM code as it is
+	stdout.Reset()
+	stderr.Reset()
+	if status := run([]string{"-v", "-O", "-stdout", source}, &stdout, &stderr); status != ExitCodeOK {
+		t.Fatalf("got: %v wanted: %v: %v", status, ExitCodeOK, stderr.String())
+	}
+	if strings.Contains(stderr.String(), "optimized:") || !strings.Contains(stdout.String(), "@3\n") {
+		t.Errorf("got: %v wanted: the VM code left unoptimized", stdout.String())
+	}
+}
+
+func TestRunShake(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"Sys.vm":  "function Sys.init 0\ncall Main.main 0\nlabel END\ngoto END\n",
+		"Main.vm": "function Main.main 0\npush constant 1\nreturn\nfunction Main.unused 0\npush constant 2\nreturn\n",
+	})
+
+	var stdout, stderr bytes.Buffer
+	if status := run([]string{"-v", "-shake", "-stdout", dir}, &stdout, &stderr); status != ExitCodeOK {
+		t.Fatalf("got: %v wanted: %v: %v", status, ExitCodeOK, stderr.String())
+	}
+	want := fmt.Sprintf("dropped Main.unused at %s:4:1 (3 commands)\n", filepath.Join(dir, "Main.vm"))
+	if !strings.Contains(stderr.String(), want) {
+		t.Errorf("got: %v wanted: %v", stderr.String(), want)
+	}
+	if strings.Contains(stdout.String(), "(Main.unused)") || !strings.Contains(stdout.String(), "(Main.main)") {
+		t.Errorf("-shake does not leave out exactly the unreachable function")
+	}
+
+	stderr.Reset()
+	if status := run([]string{"-shake", "-entry", "Main.start", "-stdout", dir}, &stdout, &stderr); status != ExitCodeError {
+		t.Fatalf("got: %v wanted: %v", status, ExitCodeError)
+	}
+	if want := "entry point Main.start is not defined\n"; stderr.String() != want {
+		t.Errorf("got: %v wanted: %v", stderr.String(), want)
+	}
+}
+
+func TestRunShakeEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"Program/Sys.vm":   "function Sys.init 0\ncall Main.main 0\nlabel END\ngoto END\n",
+		"Program/Main.vm":  "function Main.main 0\nlabel END\ngoto END\n",
+		"TopLevel/Main.vm": "push constant 1\nlabel END\ngoto END\n",
+	})
+	bootstrap := "@256\nD=A\n@SP\nM=D\n"
+
+	for _, args := range [][]string{{}, {"-bootstrap"}} {
+		var stdout, stderr bytes.Buffer
+		args = append(args, "-shake", "-entry", "Main.main", "-stdout", filepath.Join(dir, "Program"))
+		if status := run(args, &stdout, &stderr); status != ExitCodeOK {
+			t.Fatalf("%v: got: %v wanted: %v: %v", args, status, ExitCodeOK, stderr.String())
+		}
+		if !strings.HasPrefix(stdout.String(), bootstrap) || !strings.Contains(stdout.String(), "@Main.main\n0;JMP\n") {
+			t.Errorf("%v: got: %v wanted: bootstrap code calling Main.main", args, stdout.String())
+		}
+		if strings.Contains(stdout.String(), "Sys.init") {
+			t.Errorf("%v: got: %v wanted: no reference to Sys.init", args, stdout.String())
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	args := []string{"-bootstrap", "-shake", "-entry", "Main.main", "-stdout", filepath.Join(dir, "TopLevel")}
+	if status := run(args, &stdout, &stderr); status != ExitCodeError {
+		t.Fatalf("got: %v wanted: %v", status, ExitCodeError)
+	}
+	if want := "bootstrap: entry point Main.main is not defined\n"; stderr.String() != want {
+		t.Errorf("got: %v wanted: %v", stderr.String(), want)
+	}
+}
+
+func TestRunCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"Main.vm": "function Main.main 0\ncall Math.multiply 2\nreturn\n",
+	})
+	source := filepath.Join(dir, "Main.vm")
+
+	var stdout, stderr bytes.Buffer
+	if status := run([]string{"-stdout", source}, &stdout, &stderr); status != ExitCodeOK {
+		t.Fatalf("got: %v wanted: %v: %v", status, ExitCodeOK, stderr.String())
+	}
+	if status := run([]string{"-check", "-stdout", source}, &stdout, &stderr); status != ExitCodeError {
+		t.Fatalf("got: %v wanted: %v", status, ExitCodeError)
+	}
+	want := "entry point Sys.init is not defined\n" + source + ":2:1: call: function Math.multiply is not defined\n"
+	if stderr.String() != want {
+		t.Errorf("got: %v wanted: %v", stderr.String(), want)
+	}
+}
+
+func TestRunStack(t *testing.T) {
+	nested := filepath.Join("testdata", "FunctionCalls", "NestedCall")
+
+	var stdout, stderr bytes.Buffer
+	if status := run([]string{"-stack", "-stdout", nested}, &stdout, &stderr); status != ExitCodeOK {
+		t.Fatalf("got: %v wanted: %v: %v", status, ExitCodeOK, stderr.String())
+	}
+	for _, want := range []string{
+		nested + ":\n",
+		"  Sys.main: 5 locals, at most 5 values, 13 words at worst\n",
+		"  stack: 23 words of 1792\n",
+	} {
+		if !strings.Contains(stderr.String(), want) {
+			t.Errorf("got: %v wanted: %v", stderr.String(), want)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "stack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"Main.vm": "function Main.f 0\npush constant 1\npush constant 2\nreturn\n",
+	})
+	source := filepath.Join(dir, "Main.vm")
+	stderr.Reset()
+	if status := run([]string{"-stack", "-entry", "Main.f", "-stdout", source}, &stdout, &stderr); status != ExitCodeError {
+		t.Fatalf("got: %v wanted: %v", status, ExitCodeError)
+	}
+	if want := source + ":4:1: return: 2 values on the stack, wanted 1\n"; stderr.String() != want {
+		t.Errorf("got: %v wanted: %v", stderr.String(), want)
+	}
+
+	writeFiles(t, dir, map[string]string{
+		"Main.vm": "function Main.f 1\npush constant 1\nreturn\n",
+	})
+	stderr.Reset()
+	if status := run([]string{"-stack", "-entry", "Main.f", "-stdout", source}, &stdout, &stderr); status != ExitCodeOK {
+		t.Fatalf("got: %v wanted: %v: %v", status, ExitCodeOK, stderr.String())
+	}
+	if want := "  Main.f: 1 local, at most 1 value, 2 words at worst\n"; !strings.Contains(stderr.String(), want) {
+		t.Errorf("got: %v wanted: %v", stderr.String(), want)
+	}
+
+	stderr.Reset()
+	if status := run([]string{"-stack", "-entry", "Sys.nope", "-stdout", source}, &stdout, &stderr); status != ExitCodeError {
+		t.Fatalf("got: %v wanted: %v", status, ExitCodeError)
+	}
+	if want := "entry point Sys.nope is not defined\n"; stderr.String() != want {
+		t.Errorf("got: %v wanted: %v", stderr.String(), want)
+	}
+}
+
+func TestRunReport(t *testing.T) {
+	fibonacci := filepath.Join("testdata", "FunctionCalls", "FibonacciElement")
+
+	var stdout, stderr bytes.Buffer
+	if status := run([]string{"-stdout", "-report", fibonacci}, &stdout, &stderr); status != ExitCodeOK {
+		t.Fatalf("got: %v wanted: %v: %v", status, ExitCodeOK, stderr.String())
+	}
+	inline := strings.Count(stdout.String(), "\n") - strings.Count(stdout.String(), "(")
+	for _, want := range []string{
+		fibonacci + ":\n",
+		fmt.Sprintf("  inline: %d instructions\n", inline),
+		"  shared: ",
+		"  shared routines save ",
+	} {
+		if !strings.Contains(stderr.String(), want) {
+			t.Errorf("got: %v wanted: %v", stderr.String(), want)
+		}
+	}
+}
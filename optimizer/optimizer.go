@@ -0,0 +1,227 @@
+// Package optimizer rewrites parsed VM programs into equivalent ones made of fewer commands.
+// It runs between the parser and the code writer, on programs which have been validated.
+package optimizer
+
+import (
+	"fmt"
+
+	"github.com/sato11/the-hack-vm-translator/parser"
+)
+
+// Stats counts the commands removed by Optimize, by the reason they were removed for.
+type Stats struct {
+	// Before and After are the numbers of commands of the program before and after optimization.
+	Before, After int
+	// Folded is the number of commands saved by folding constant arithmetic.
+	Folded int
+	// Unreachable is the number of commands removed as they follow a goto or a return.
+	Unreachable int
+	// Labels is the number of labels removed as no goto or if-goto targets them.
+	Labels int
+	// Jumps is the number of gotos removed as they target the command right after them.
+	Jumps int
+}
+
+// Eliminated returns the number of commands Optimize removed.
+func (s Stats) Eliminated() int {
+	return s.Before - s.After
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%d of %d commands eliminated: %d folded, %d unreachable, %d unused labels, %d jumps to the next command",
+		s.Eliminated(), s.Before, s.Folded, s.Unreachable, s.Labels, s.Jumps)
+}
+
+// Optimize returns files with constant arithmetic folded, such as push constant 3, push constant 4, add
+// into push constant 7, with the commands following a goto or a return up to the next label or function
+// removed, and with the labels no goto or if-goto targets and the gotos to the next command removed.
+// The passes are repeated until none of them changes anything. files are left as they are.
+func Optimize(files []*parser.File) ([]*parser.File, Stats) {
+	var stats Stats
+	optimized := make([]*parser.File, len(files))
+	for i, file := range files {
+		stats.Before += len(file.Commands)
+		optimized[i] = &parser.File{
+			Name:      file.Name,
+			Namespace: file.Namespace,
+			Commands:  append([]parser.Command(nil), file.Commands...),
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		targets := targets(optimized)
+		for _, file := range optimized {
+			before := len(file.Commands)
+			file.Commands = fold(file.Commands, &stats)
+			file.Commands = removeUnreachable(file.Commands, &stats)
+			file.Commands = removeJumpsToNext(file.Commands, &stats)
+			file.Commands = removeUnusedLabels(file.Commands, targets, &stats)
+			changed = changed || len(file.Commands) != before
+		}
+	}
+
+	for _, file := range optimized {
+		stats.After += len(file.Commands)
+	}
+	return optimized, stats
+}
+
+// targets returns the labels some goto or if-goto of files targets.
+// Labels are told apart by name only, so that a label is kept whichever function it belongs to.
+func targets(files []*parser.File) map[string]bool {
+	labels := make(map[string]bool)
+	for _, file := range files {
+		for _, command := range file.Commands {
+			if command.Type == parser.GotoCommand || command.Type == parser.IfCommand {
+				labels[command.Name] = true
+			}
+		}
+	}
+	return labels
+}
+
+// constant returns the value pushed by the commands ending at commands[end], if they push a constant,
+// and the number of commands doing so: either push constant n or push constant n, not.
+func constant(commands []parser.Command, end int) (int16, int, bool) {
+	if end < 0 {
+		return 0, 0, false
+	}
+	c := commands[end]
+	if c.Type == parser.PushCommand && c.Segment == parser.ConstantSegment {
+		return int16(c.Index), 1, true
+	}
+	if c.Type == parser.ArithmeticCommand && c.Name == "not" && end > 0 {
+		if value, n, ok := constant(commands, end-1); ok && n == 1 {
+			return ^value, 2, true
+		}
+	}
+	return 0, 0, false
+}
+
+// pushConstant returns the commands pushing value, positioned at pos.
+// Negative values, which the constant segment does not hold, are pushed as the complement of their complement.
+func pushConstant(value int16, pos parser.Position) []parser.Command {
+	if value >= 0 {
+		return []parser.Command{{Type: parser.PushCommand, Segment: parser.ConstantSegment, Index: int(value), Pos: pos}}
+	}
+	return []parser.Command{
+		{Type: parser.PushCommand, Segment: parser.ConstantSegment, Index: int(^value), Pos: pos},
+		{Type: parser.ArithmeticCommand, Name: "not", Pos: pos},
+	}
+}
+
+// truth returns the value of a comparison, -1 for true and 0 for false.
+func truth(b bool) int16 {
+	if b {
+		return -1
+	}
+	return 0
+}
+
+// unary and binary compute the arithmetic and logical commands as the Hack computer does.
+var (
+	unary = map[string]func(int16) int16{
+		"neg": func(x int16) int16 { return -x },
+		"not": func(x int16) int16 { return ^x },
+	}
+	binary = map[string]func(int16, int16) int16{
+		"add": func(x, y int16) int16 { return x + y },
+		"sub": func(x, y int16) int16 { return x - y },
+		"and": func(x, y int16) int16 { return x & y },
+		"or":  func(x, y int16) int16 { return x | y },
+		"eq":  func(x, y int16) int16 { return truth(x == y) },
+		"gt":  func(x, y int16) int16 { return truth(x > y) },
+		"lt":  func(x, y int16) int16 { return truth(x < y) },
+	}
+)
+
+// fold replaces arithmetic and logical commands applied to constants by the constant they compute,
+// whenever that takes fewer commands.
+func fold(commands []parser.Command, stats *Stats) []parser.Command {
+	var out []parser.Command
+	for _, command := range commands {
+		out = append(out, command)
+		for command.Type == parser.ArithmeticCommand {
+			end := len(out) - 2
+			var value int16
+			var n int
+			if f, ok := unary[command.Name]; ok {
+				x, nx, ok := constant(out, end)
+				if !ok {
+					break
+				}
+				value, n = f(x), nx+1
+			} else {
+				y, ny, ok := constant(out, end)
+				if !ok {
+					break
+				}
+				x, nx, ok := constant(out, end-ny)
+				if !ok {
+					break
+				}
+				value, n = binary[command.Name](x, y), nx+ny+1
+			}
+
+			start := len(out) - n
+			folded := pushConstant(value, out[start].Pos)
+			if len(folded) >= n {
+				break
+			}
+			stats.Folded += n - len(folded)
+			out = append(out[:start], folded...)
+			// the constant may in turn be the operand of a command folded before
+			command = out[len(out)-1]
+		}
+	}
+	return out
+}
+
+// removeUnreachable removes the commands following a goto or a return up to the next label or function,
+// which nothing can jump to.
+func removeUnreachable(commands []parser.Command, stats *Stats) []parser.Command {
+	var out []parser.Command
+	reachable := true
+	for _, command := range commands {
+		if command.Type == parser.LabelCommand || command.Type == parser.FunctionCommand {
+			reachable = true
+		}
+		if !reachable {
+			stats.Unreachable++
+			continue
+		}
+		out = append(out, command)
+		if command.Type == parser.GotoCommand || command.Type == parser.ReturnCommand {
+			reachable = false
+		}
+	}
+	return out
+}
+
+// removeJumpsToNext removes gotos immediately followed by the label they target.
+func removeJumpsToNext(commands []parser.Command, stats *Stats) []parser.Command {
+	var out []parser.Command
+	for i, command := range commands {
+		if command.Type == parser.GotoCommand && i+1 < len(commands) &&
+			commands[i+1].Type == parser.LabelCommand && commands[i+1].Name == command.Name {
+			stats.Jumps++
+			continue
+		}
+		out = append(out, command)
+	}
+	return out
+}
+
+// removeUnusedLabels removes the labels which are not among targets.
+func removeUnusedLabels(commands []parser.Command, targets map[string]bool, stats *Stats) []parser.Command {
+	var out []parser.Command
+	for _, command := range commands {
+		if command.Type == parser.LabelCommand && !targets[command.Name] {
+			stats.Labels++
+			continue
+		}
+		out = append(out, command)
+	}
+	return out
+}
@@ -0,0 +1,120 @@
+package optimizer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sato11/the-hack-vm-translator/parser"
+)
+
+func parse(t *testing.T, source string) []*parser.File {
+	t.Helper()
+	file, err := parser.ParseFile("Test.vm", strings.NewReader(source))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return []*parser.File{file}
+}
+
+func source(files []*parser.File) string {
+	var b strings.Builder
+	for _, file := range files {
+		for _, command := range file.Commands {
+			b.WriteString(command.String() + "\n")
+		}
+	}
+	return b.String()
+}
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+		stats  Stats
+	}{
+		{
+			"add",
+			"push constant 3\npush constant 4\nadd\n",
+			"push constant 7\n",
+			Stats{Before: 3, After: 1, Folded: 2},
+		},
+		{
+			"true",
+			"push constant 0\nnot\n",
+			"push constant 0\nnot\n",
+			Stats{Before: 2, After: 2},
+		},
+		{
+			"negative result",
+			"push constant 3\npush constant 5\nsub\n",
+			"push constant 1\nnot\n",
+			Stats{Before: 3, After: 2, Folded: 1},
+		},
+		{
+			"overflow",
+			"push constant 32767\npush constant 1\nadd\n",
+			"push constant 32767\nnot\n",
+			Stats{Before: 3, After: 2, Folded: 1},
+		},
+		{
+			"comparison",
+			"push constant 0\nnot\npush constant 1\ngt\n",
+			"push constant 0\n",
+			Stats{Before: 4, After: 1, Folded: 3},
+		},
+		{
+			"nested",
+			"push constant 1\npush constant 2\npush constant 3\nadd\nadd\nneg\n",
+			"push constant 6\nneg\n",
+			Stats{Before: 6, After: 2, Folded: 4},
+		},
+		{
+			"operand not constant",
+			"push local 0\npush constant 1\nadd\n",
+			"push local 0\npush constant 1\nadd\n",
+			Stats{Before: 3, After: 3},
+		},
+		{
+			"label between constants",
+			"push constant 1\nlabel L\npush constant 2\nadd\ngoto L\n",
+			"push constant 1\nlabel L\npush constant 2\nadd\ngoto L\n",
+			Stats{Before: 5, After: 5},
+		},
+		{
+			"unreachable",
+			"function F 0\npush constant 1\nreturn\npush constant 2\npop local 0\nfunction G 0\ngoto END\nadd\nlabel END\ngoto END\n",
+			"function F 0\npush constant 1\nreturn\nfunction G 0\nlabel END\ngoto END\n",
+			Stats{Before: 10, After: 6, Unreachable: 3, Jumps: 1},
+		},
+		{
+			"unused labels",
+			"label A\nlabel B\npush constant 1\nif-goto B\n",
+			"label B\npush constant 1\nif-goto B\n",
+			Stats{Before: 4, After: 3, Labels: 1},
+		},
+		{
+			"unreachable once the label is gone",
+			"goto A\nlabel A\ngoto B\nlabel C\npush constant 1\nlabel B\n",
+			"",
+			Stats{Before: 6, After: 0, Jumps: 2, Labels: 3, Unreachable: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		files := parse(t, tt.source)
+		optimized, stats := Optimize(files)
+		if got := source(optimized); got != tt.want {
+			t.Errorf("%s: got:\n%s\nwanted:\n%s", tt.name, got, tt.want)
+		}
+		if stats != tt.stats {
+			t.Errorf("%s: got: %+v wanted: %+v", tt.name, stats, tt.stats)
+		}
+		if stats.Eliminated() != stats.Folded+stats.Unreachable+stats.Labels+stats.Jumps {
+			t.Errorf("%s: eliminated %d commands, not the sum of %+v", tt.name, stats.Eliminated(), stats)
+		}
+		if got := source(files); got != tt.source {
+			t.Errorf("%s: the input was changed into:\n%s", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Segment represents a virtual memory segment accessed by push and pop.
+type Segment int
+
+const (
+	// NoSegment is used for commands that do not access a memory segment.
+	NoSegment Segment = iota
+	// ConstantSegment represents the constant segment.
+	ConstantSegment
+	// LocalSegment represents the local segment.
+	LocalSegment
+	// ArgumentSegment represents the argument segment.
+	ArgumentSegment
+	// ThisSegment represents the this segment.
+	ThisSegment
+	// ThatSegment represents the that segment.
+	ThatSegment
+	// TempSegment represents the temp segment.
+	TempSegment
+	// PointerSegment represents the pointer segment.
+	PointerSegment
+	// StaticSegment represents the static segment.
+	StaticSegment
+)
+
+var segmentNames = []string{
+	NoSegment:       "",
+	ConstantSegment: "constant",
+	LocalSegment:    "local",
+	ArgumentSegment: "argument",
+	ThisSegment:     "this",
+	ThatSegment:     "that",
+	TempSegment:     "temp",
+	PointerSegment:  "pointer",
+	StaticSegment:   "static",
+}
+
+// String returns the name of the segment as written in VM code.
+func (s Segment) String() string {
+	if s < 0 || int(s) >= len(segmentNames) {
+		return fmt.Sprintf("Segment(%d)", int(s))
+	}
+	return segmentNames[s]
+}
+
+// LookupSegment returns the segment with the given name.
+// The second return value reports whether the name is a valid segment.
+func LookupSegment(name string) (Segment, bool) {
+	for s, n := range segmentNames {
+		if name != "" && n == name {
+			return Segment(s), true
+		}
+	}
+	return NoSegment, false
+}
+
+// Command is a single parsed VM command.
+type Command struct {
+	// Type is the kind of the command.
+	Type CommandTypes
+	// Name is the operator of an ArithmeticCommand,
+	// the label of LabelCommand, GotoCommand and IfCommand,
+	// or the function name of FunctionCommand and CallCommand.
+	Name string
+	// Segment is the memory segment of PushCommand and PopCommand.
+	Segment Segment
+	// Index is the segment index of PushCommand and PopCommand,
+	// the number of locals of FunctionCommand,
+	// or the number of arguments of CallCommand.
+	Index int
+	// Pos is where the command appears in the source.
+	Pos Position
+}
+
+// String returns the command as VM code.
+func (c Command) String() string {
+	switch c.Type {
+	case ArithmeticCommand:
+		return c.Name
+	case PushCommand:
+		return fmt.Sprintf("push %s %d", c.Segment, c.Index)
+	case PopCommand:
+		return fmt.Sprintf("pop %s %d", c.Segment, c.Index)
+	case LabelCommand:
+		return "label " + c.Name
+	case GotoCommand:
+		return "goto " + c.Name
+	case IfCommand:
+		return "if-goto " + c.Name
+	case FunctionCommand:
+		return fmt.Sprintf("function %s %d", c.Name, c.Index)
+	case CallCommand:
+		return fmt.Sprintf("call %s %d", c.Name, c.Index)
+	case ReturnCommand:
+		return "return"
+	default:
+		return fmt.Sprintf("Command(%d)", int(c.Type))
+	}
+}
+
+// Parse converts the current command into a Command.
+func (p *Parser) Parse() (Command, error) {
+	command := Command{
+		Type: p.CommandType(),
+		Pos:  p.Position(),
+	}
+
+	switch command.Type {
+	case ArithmeticCommand:
+		command.Name = p.Command()
+
+	case PushCommand, PopCommand:
+		name, err := p.requireArg1("segment")
+		if err != nil {
+			return Command{}, err
+		}
+		segment, ok := LookupSegment(name)
+		if !ok {
+			return Command{}, p.errorfAt(1, "%s: unknown segment %q", p.Command(), name)
+		}
+		command.Segment = segment
+		command.Index, err = p.parseArg2("index")
+		if err != nil {
+			return Command{}, err
+		}
+
+	case LabelCommand, GotoCommand, IfCommand:
+		name, err := p.requireArg1("label")
+		if err != nil {
+			return Command{}, err
+		}
+		command.Name = name
+
+	case FunctionCommand, CallCommand:
+		name, err := p.requireArg1("function name")
+		if err != nil {
+			return Command{}, err
+		}
+		command.Name = name
+		count := "number of locals"
+		if command.Type == CallCommand {
+			count = "number of arguments"
+		}
+		command.Index, err = p.parseArg2(count)
+		if err != nil {
+			return Command{}, err
+		}
+	}
+
+	if n := numArgs(command.Type) + 1; len(p.currentCommand.tokens) > n {
+		return Command{}, p.errorfAt(n, "%s: unexpected %q after command", p.Command(), p.field(n))
+	}
+
+	return command, nil
+}
+
+// numArgs returns the number of arguments taken by commands of the given type.
+func numArgs(t CommandTypes) int {
+	switch t {
+	case PushCommand, PopCommand, FunctionCommand, CallCommand:
+		return 2
+	case LabelCommand, GotoCommand, IfCommand:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Commands parses all of the remaining commands.
+// Commands that fail to parse are skipped, and their errors are returned together as an ErrorList,
+// followed by the error which stopped the reading of the input, if any.
+func (p *Parser) Commands() ([]Command, error) {
+	var commands []Command
+	var errs ErrorList
+	for p.HasMoreCommands() {
+		p.Advance()
+		command, err := p.Parse()
+		if err != nil {
+			errs = append(errs, err.(*Error))
+			continue
+		}
+		commands = append(commands, command)
+	}
+	if p.readErr != nil {
+		errs.Add(Position{p.filename, p.readLine, 1}, p.readErr)
+	}
+	return commands, errs.Err()
+}
+
+// requireArg1 returns the first argument of the current command,
+// reporting an error if it is missing.
+func (p *Parser) requireArg1(name string) (string, error) {
+	arg := p.Arg1()
+	if arg == "" {
+		return "", p.Errorf("%s: missing %s", p.Command(), name)
+	}
+	return arg, nil
+}
+
+// parseArg2 converts the second argument of the current command into an integer.
+func (p *Parser) parseArg2(name string) (int, error) {
+	arg := p.Arg2()
+	if arg == "" {
+		return 0, p.Errorf("%s: missing %s", p.Command(), name)
+	}
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, p.errorfAt(2, "%s: invalid %s %q", p.Command(), name, arg)
+	}
+	return n, nil
+}
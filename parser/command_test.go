@@ -0,0 +1,120 @@
+package parser
+
+import (
+	"bytes"
+	"testing"
+)
+
+type lookupSegmentTest struct {
+	name    string
+	segment Segment
+	ok      bool
+}
+
+func TestLookupSegment(t *testing.T) {
+	tests := []lookupSegmentTest{
+		{"constant", ConstantSegment, true},
+		{"local", LocalSegment, true},
+		{"argument", ArgumentSegment, true},
+		{"this", ThisSegment, true},
+		{"that", ThatSegment, true},
+		{"temp", TempSegment, true},
+		{"pointer", PointerSegment, true},
+		{"static", StaticSegment, true},
+		{"", NoSegment, false},
+		{"heap", NoSegment, false},
+	}
+	for i, test := range tests {
+		segment, ok := LookupSegment(test.name)
+		if segment != test.segment || ok != test.ok {
+			t.Errorf("#%d: got: %v, %v wanted: %v, %v", i, segment, ok, test.segment, test.ok)
+		}
+		if ok && segment.String() != test.name {
+			t.Errorf("#%d: got: %v wanted: %v", i, segment.String(), test.name)
+		}
+	}
+}
+
+type parseTest struct {
+	command string
+	out     Command
+}
+
+func TestParse(t *testing.T) {
+	tests := []parseTest{
+		{"add", Command{ArithmeticCommand, "add", NoSegment, 0, Position{"Test.vm", 1, 1}}},
+		{"push constant 7", Command{PushCommand, "", ConstantSegment, 7, Position{"Test.vm", 1, 1}}},
+		{"pop local 2", Command{PopCommand, "", LocalSegment, 2, Position{"Test.vm", 1, 1}}},
+		{"label LOOP", Command{LabelCommand, "LOOP", NoSegment, 0, Position{"Test.vm", 1, 1}}},
+		{"goto LOOP", Command{GotoCommand, "LOOP", NoSegment, 0, Position{"Test.vm", 1, 1}}},
+		{"if-goto END", Command{IfCommand, "END", NoSegment, 0, Position{"Test.vm", 1, 1}}},
+		{"function Main.main 3", Command{FunctionCommand, "Main.main", NoSegment, 3, Position{"Test.vm", 1, 1}}},
+		{"call Math.multiply 2", Command{CallCommand, "Math.multiply", NoSegment, 2, Position{"Test.vm", 1, 1}}},
+		{"return", Command{ReturnCommand, "", NoSegment, 0, Position{"Test.vm", 1, 1}}},
+	}
+	for i, test := range tests {
+		p := New(bytes.NewBufferString(test.command))
+		p.SetFileName("Test.vm")
+		p.Advance()
+		command, err := p.Parse()
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		} else if command != test.out {
+			t.Errorf("#%d: got: %v wanted: %v", i, command, test.out)
+		}
+		if command.String() != test.command {
+			t.Errorf("#%d: got: %v wanted: %v", i, command.String(), test.command)
+		}
+	}
+}
+
+type parseErrorTest struct {
+	command string
+	err     string
+}
+
+func TestParseError(t *testing.T) {
+	tests := []parseErrorTest{
+		{"push", "Test.vm:1:1: push: missing segment"},
+		{"push constant", "Test.vm:1:1: push: missing index"},
+		{"push constant x", `Test.vm:1:15: push: invalid index "x"`},
+		{"pop heap 0", `Test.vm:1:5: pop: unknown segment "heap"`},
+		{"goto", "Test.vm:1:1: goto: missing label"},
+		{"function", "Test.vm:1:1: function: missing function name"},
+		{"function Main.main", "Test.vm:1:1: function: missing number of locals"},
+		{"call Math.multiply two", `Test.vm:1:20: call: invalid number of arguments "two"`},
+		{"add 1", `Test.vm:1:5: add: unexpected "1" after command`},
+		{"return x", `Test.vm:1:8: return: unexpected "x" after command`},
+		{"goto LOOP END", `Test.vm:1:11: goto: unexpected "END" after command`},
+		{"push constant 7 8", `Test.vm:1:17: push: unexpected "8" after command`},
+		{"\tpush\tconstant  7\tx\r", `Test.vm:1:19: push: unexpected "x" after command`},
+	}
+	for i, test := range tests {
+		p := New(bytes.NewBufferString(test.command))
+		p.SetFileName("Test.vm")
+		p.Advance()
+		_, err := p.Parse()
+		if err == nil {
+			t.Errorf("#%d: got: nil wanted: %v", i, test.err)
+		} else if err.Error() != test.err {
+			t.Errorf("#%d: got: %v wanted: %v", i, err.Error(), test.err)
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	p := New(bytes.NewBufferString("push constant 7\npush constant 8\nadd\npush x 0\nadd\npop local"))
+	commands, err := p.Commands()
+	if len(commands) != 4 {
+		t.Errorf("got: %v wanted: %v", len(commands), 4)
+	}
+
+	errs, ok := err.(ErrorList)
+	if !ok {
+		t.Fatalf("got: %T wanted: ErrorList", err)
+	}
+	expected := "4:6: push: unknown segment \"x\"\n6:1: pop: missing index"
+	if len(errs) != 2 || errs.Error() != expected {
+		t.Errorf("got: %v wanted: %v", errs.Error(), expected)
+	}
+}
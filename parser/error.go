@@ -0,0 +1,85 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Position describes a location in a .vm source file.
+// Line and Column are 1-based.
+type Position struct {
+	Filename string
+	Line     int
+	Column   int
+}
+
+// String returns the position in the form file:line:column.
+func (p Position) String() string {
+	s := p.Filename
+	if p.Line > 0 {
+		if s != "" {
+			s += ":"
+		}
+		s += fmt.Sprintf("%d:%d", p.Line, p.Column)
+	}
+	return s
+}
+
+// Error is an error associated with a source position.
+type Error struct {
+	Pos Position
+	Err error
+}
+
+// Error returns the error message prefixed by its position.
+func (e *Error) Error() string {
+	if pos := e.Pos.String(); pos != "" {
+		return fmt.Sprintf("%s: %s", pos, e.Err.Error())
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrorList is a list of errors found while parsing or validating VM code.
+type ErrorList []*Error
+
+// Add appends an error at the given position.
+func (l *ErrorList) Add(pos Position, err error) {
+	*l = append(*l, &Error{pos, err})
+}
+
+// Sort sorts the list by file name, line and column.
+func (l ErrorList) Sort() {
+	sort.SliceStable(l, func(i, j int) bool {
+		a, b := l[i].Pos, l[j].Pos
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
+
+// Error returns the messages of all errors, one per line.
+func (l ErrorList) Error() string {
+	messages := make([]string, len(l))
+	for i, err := range l {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Err returns nil if the list is empty, or the list itself otherwise.
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
@@ -0,0 +1,33 @@
+package parser
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// File holds the commands of a single .vm file.
+type File struct {
+	// Name is the path the file was read from.
+	Name string
+	// Namespace is the base name of the file without its extension,
+	// which qualifies the static variables of the file.
+	Namespace string
+	// Commands are the parsed commands in source order.
+	Commands []Command
+}
+
+// ParseFile parses every command read from r.
+// filename is used for positions and to derive the namespace of the file.
+// Commands that fail to parse are left out of the File and reported together as an ErrorList.
+func ParseFile(filename string, r io.Reader) (*File, error) {
+	p := New(r)
+	p.SetFileName(filename)
+	commands, err := p.Commands()
+
+	return &File{
+		filename,
+		strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename)),
+		commands,
+	}, err
+}
@@ -0,0 +1,54 @@
+package parser
+
+import (
+	"bufio"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type parseFileTest struct {
+	filename  string
+	namespace string
+}
+
+func TestParseFile(t *testing.T) {
+	tests := []parseFileTest{
+		{"Main.vm", "Main"},
+		{filepath.Join("path", "to", "Sys.vm"), "Sys"},
+		{"Main", "Main"},
+	}
+	for i, test := range tests {
+		file, err := ParseFile(test.filename, strings.NewReader("push constant 1\npop local 0"))
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if file.Name != test.filename || file.Namespace != test.namespace {
+			t.Errorf("#%d: got: %v, %v wanted: %v, %v", i, file.Name, file.Namespace, test.filename, test.namespace)
+		}
+		if len(file.Commands) != 2 || file.Commands[1].Pos != (Position{test.filename, 2, 1}) {
+			t.Errorf("#%d: got: %v wanted: %v", i, file.Commands, 2)
+		}
+	}
+}
+
+func TestParseFileErrors(t *testing.T) {
+	file, err := ParseFile("Main.vm", strings.NewReader("push constant\nadd\npop heap 1"))
+	if len(file.Commands) != 1 {
+		t.Errorf("got: %v wanted: %v", len(file.Commands), 1)
+	}
+	checkErrors(t, 0, err, []string{
+		"Main.vm:1:1: push: missing index",
+		`Main.vm:3:5: pop: unknown segment "heap"`,
+	})
+
+	// a line too long for the scanner stops the reading, which must not go unnoticed
+	long := "push constant 1\n// " + strings.Repeat("x", bufio.MaxScanTokenSize) + "\npush constant 2\n"
+	file, err = ParseFile("Main.vm", strings.NewReader(long))
+	if len(file.Commands) != 1 {
+		t.Errorf("got: %v wanted: %v", len(file.Commands), 1)
+	}
+	checkErrors(t, 0, err, []string{
+		"Main.vm:2:1: bufio.Scanner: token too long",
+	})
+}
@@ -2,33 +2,81 @@ package parser
 
 import (
 	"bufio"
+	"fmt"
 	"io"
-	"strings"
 )
 
+// line is the tokens of a single command along with the line it was found on.
+type line struct {
+	tokens []Token
+	line   int
+}
+
 // Parser handles the parsing of a single .vm file and encapsulates access to the input code.
 type Parser struct {
-	currentCommand string
-	lines          []string
+	filename       string
+	currentCommand line
+	lines          []line
+	// readErr is the error which stopped the reading of the input at the line readLine, if any.
+	readErr  error
+	readLine int
 }
 
 // New initializes the parser and gets ready to parse the input stream.
+// An error reading it, such as a line too long, is reported by Commands once the lines read are parsed.
 func New(r io.Reader) *Parser {
-	var lines []string
+	var lines []line
 	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		line := scanner.Text()
-		line = strings.Split(line, "//")[0] // remove comments
-		line = strings.Trim(line, " \t")    // remove whitespaces
-		if line != "" {
-			lines = append(lines, line)
+	number := 1
+	for ; scanner.Scan(); number++ {
+		tokens := Tokenize(scanner.Text())
+		if len(tokens) != 0 {
+			lines = append(lines, line{tokens, number})
 		}
 	}
 
 	return &Parser{
 		"",
+		line{},
 		lines,
+		scanner.Err(),
+		number,
+	}
+}
+
+// SetFileName informs the parser of the name of the file it is reading,
+// which is reported as part of every position.
+func (p *Parser) SetFileName(filename string) {
+	p.filename = filename
+}
+
+// Position returns the source position of the current command.
+func (p *Parser) Position() Position {
+	return p.tokenPosition(0)
+}
+
+// Errorf returns an error at the position of the current command.
+func (p *Parser) Errorf(format string, a ...interface{}) error {
+	return &Error{p.Position(), fmt.Errorf(format, a...)}
+}
+
+// tokenPosition returns the source position of the nth token of the current command.
+// The position of the command itself is returned if there is no such token.
+func (p *Parser) tokenPosition(n int) Position {
+	tokens := p.currentCommand.tokens
+	if n >= len(tokens) {
+		n = 0
 	}
+	column := 0
+	if n < len(tokens) {
+		column = tokens[n].Column
+	}
+	return Position{p.filename, p.currentCommand.line, column}
+}
+
+// errorfAt returns an error at the position of the nth token of the current command.
+func (p *Parser) errorfAt(n int, format string, a ...interface{}) error {
+	return &Error{p.tokenPosition(n), fmt.Errorf(format, a...)}
 }
 
 // HasMoreCommands returns true if there are more commands to parse.
@@ -67,6 +115,26 @@ const (
 	CallCommand
 )
 
+var commandNames = []string{
+	ArithmeticCommand: "arithmetic",
+	PushCommand:       "push",
+	PopCommand:        "pop",
+	LabelCommand:      "label",
+	GotoCommand:       "goto",
+	IfCommand:         "if-goto",
+	FunctionCommand:   "function",
+	ReturnCommand:     "return",
+	CallCommand:       "call",
+}
+
+// String returns the keyword of the command type as written in VM code.
+func (t CommandTypes) String() string {
+	if t < 0 || int(t) >= len(commandNames) {
+		return fmt.Sprintf("CommandTypes(%d)", int(t))
+	}
+	return commandNames[t]
+}
+
 // CommandType returns the type of the current VM command.
 // Arithmetic is returned for all the arithmetic commands.
 func (p *Parser) CommandType() CommandTypes {
@@ -92,23 +160,33 @@ func (p *Parser) CommandType() CommandTypes {
 	}
 }
 
-// Command returns
+// Command returns the name of the current command, e.g. push or add.
 func (p *Parser) Command() string {
-	return strings.Split(p.currentCommand, " ")[0]
+	return p.field(0)
 }
 
 // Arg1 returns the first argument of the current command.
 // In the case of ArithmeticCommand, the command itself (add, sub, etc.) is returned.
-// Should not be called if the current command is ReturnCommand.
+// An empty string is returned if the argument is missing.
 func (p *Parser) Arg1() string {
 	if p.CommandType() == ArithmeticCommand {
-		return p.currentCommand
+		return p.Command()
 	}
-	return strings.Split(p.currentCommand, " ")[1]
+	return p.field(1)
 }
 
 // Arg2 returns the second argument of the current command.
-// Should be called only if the current command is PushCommand, PopCommand, FunctionCommand or CallCommand.
+// An empty string is returned if the argument is missing.
 func (p *Parser) Arg2() string {
-	return strings.Split(p.currentCommand, " ")[2]
+	return p.field(2)
+}
+
+// field returns the nth token of the current command,
+// or an empty string if there is no such token.
+func (p *Parser) field(n int) string {
+	tokens := p.currentCommand.tokens
+	if n >= len(tokens) {
+		return ""
+	}
+	return tokens[n].Text
 }
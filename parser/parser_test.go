@@ -2,9 +2,30 @@ package parser
 
 import (
 	"bytes"
+	"errors"
+	"strings"
 	"testing"
 )
 
+// newParser builds a parser whose current command is command and
+// whose remaining commands are lines.
+func newParser(command string, lines []string) *Parser {
+	var ls []line
+	for i, text := range lines {
+		ls = append(ls, line{Tokenize(text), i + 1})
+	}
+	return &Parser{"", line{Tokenize(command), 0}, ls, nil, 0}
+}
+
+// text joins the tokens of l with single spaces.
+func text(l line) string {
+	var words []string
+	for _, token := range l.tokens {
+		words = append(words, token.Text)
+	}
+	return strings.Join(words, " ")
+}
+
 type newTest struct {
 	reader string
 	lines  []string
@@ -19,6 +40,8 @@ func TestNew(t *testing.T) {
 		{"push constant 0", []string{"push constant 0"}},
 		{"// comment\npush constant 0", []string{"push constant 0"}},
 		{"push constant 0\npop local 0", []string{"push constant 0", "pop local 0"}},
+		{"push  constant\t0\r\n\tpop local 0 \r\n", []string{"push constant 0", "pop local 0"}},
+		{"push constant 0// comment", []string{"push constant 0"}},
 	}
 	for i, test := range tests {
 		b := bytes.NewBufferString(test.reader)
@@ -27,8 +50,8 @@ func TestNew(t *testing.T) {
 			t.Errorf("#%d: got %v wanted %v", i, len(p.lines), len(test.lines))
 		} else {
 			for j := range p.lines {
-				if p.lines[j] != test.lines[j] {
-					t.Errorf("#%d: got: %v wanted: %v", j, p.lines[j], test.lines[j])
+				if text(p.lines[j]) != test.lines[j] {
+					t.Errorf("#%d: got: %v wanted: %v", j, text(p.lines[j]), test.lines[j])
 				}
 			}
 		}
@@ -47,7 +70,7 @@ func TestHasMoreCommands(t *testing.T) {
 		{[]string{"push constant 0", "pop local 0"}, true},
 	}
 	for i, test := range tests {
-		p := &Parser{"", test.lines}
+		p := newParser("", test.lines)
 		if p.HasMoreCommands() != test.out {
 			t.Errorf("#%d: got: %v wanted: %v", i, p.HasMoreCommands(), test.out)
 		}
@@ -66,19 +89,19 @@ func TestAdvance(t *testing.T) {
 		{[]string{"push constant 0", "pop local 0"}, []string{"pop local 0"}, "push constant 0"},
 	}
 	for i, test := range tests {
-		p := &Parser{"", test.before}
+		p := newParser("", test.before)
 		p.Advance()
 
-		if p.currentCommand != test.command {
-			t.Errorf("#%d: got: %v wanted: %v", i, p.currentCommand, test.command)
+		if text(p.currentCommand) != test.command {
+			t.Errorf("#%d: got: %v wanted: %v", i, text(p.currentCommand), test.command)
 		}
 
 		if len(p.lines) != len(test.after) {
 			t.Errorf("#%d: got: %v wanted: %v", i, p.lines, test.after)
 		} else {
 			for j := range p.lines {
-				if p.lines[j] != test.after[j] {
-					t.Errorf("#%d: got: %v wanted: %v", j, p.lines[j], test.after[j])
+				if text(p.lines[j]) != test.after[j] {
+					t.Errorf("#%d: got: %v wanted: %v", j, text(p.lines[j]), test.after[j])
 				}
 			}
 		}
@@ -105,7 +128,7 @@ func TestCommandType(t *testing.T) {
 		{"lt", ArithmeticCommand},
 	}
 	for i, test := range tests {
-		p := &Parser{test.command, []string{}}
+		p := newParser(test.command, []string{})
 		if p.CommandType() != test.out {
 			t.Errorf("#%d: got: %v wanted: %v", i, p.CommandType(), test.out)
 		}
@@ -132,7 +155,7 @@ func TestCommand(t *testing.T) {
 		{"lt", "lt"},
 	}
 	for i, test := range tests {
-		p := &Parser{test.command, []string{}}
+		p := newParser(test.command, []string{})
 		if p.Command() != test.out {
 			t.Errorf("#%d: got: %v wanted: %v", i, p.Command(), test.out)
 		}
@@ -153,7 +176,7 @@ func TestArg1(t *testing.T) {
 		{"lt", "lt"},
 	}
 	for i, test := range tests {
-		p := &Parser{test.command, []string{}}
+		p := newParser(test.command, []string{})
 		if p.Arg1() != test.out {
 			t.Errorf("#%d: got: %v wanted %v", i, p.Arg1(), test.out)
 		}
@@ -166,11 +189,70 @@ func TestArg2(t *testing.T) {
 		{"pop location 1", "1"},
 		{"function mult 2", "2"},
 		{"call mult 2 5", "2"},
+		{"push constant", ""},
 	}
 	for i, test := range tests {
-		p := &Parser{test.command, []string{}}
+		p := newParser(test.command, []string{})
 		if p.Arg2() != test.out {
 			t.Errorf("#%d: got: %v wanted %v", i, p.Arg2(), test.out)
 		}
 	}
 }
+
+type positionTest struct {
+	reader    string
+	positions []Position
+}
+
+func TestPosition(t *testing.T) {
+	tests := []positionTest{
+		{"push constant 0", []Position{{"Test.vm", 1, 1}}},
+		{"// comment\n\n  push constant 0\n\tadd // comment", []Position{{"Test.vm", 3, 3}, {"Test.vm", 4, 2}}},
+	}
+	for i, test := range tests {
+		p := New(bytes.NewBufferString(test.reader))
+		p.SetFileName("Test.vm")
+		for j, position := range test.positions {
+			p.Advance()
+			if p.Position() != position {
+				t.Errorf("#%d-%d: got: %v wanted: %v", i, j, p.Position(), position)
+			}
+		}
+	}
+}
+
+type errorTest struct {
+	err *Error
+	out string
+}
+
+func TestError(t *testing.T) {
+	tests := []errorTest{
+		{&Error{Position{"File.vm", 12, 5}, errors.New("message")}, "File.vm:12:5: message"},
+		{&Error{Position{"", 12, 5}, errors.New("message")}, "12:5: message"},
+		{&Error{Position{"File.vm", 0, 0}, errors.New("message")}, "File.vm: message"},
+		{&Error{Position{}, errors.New("message")}, "message"},
+	}
+	for i, test := range tests {
+		if test.err.Error() != test.out {
+			t.Errorf("#%d: got: %v wanted: %v", i, test.err.Error(), test.out)
+		}
+	}
+}
+
+func TestErrorf(t *testing.T) {
+	p := New(bytes.NewBufferString("\n  push constant x"))
+	p.SetFileName("File.vm")
+	p.Advance()
+
+	err := p.Errorf("invalid index %q", p.Arg2())
+	expected := `File.vm:2:3: invalid index "x"`
+	if err.Error() != expected {
+		t.Errorf("got: %v wanted: %v", err.Error(), expected)
+	}
+
+	var e *Error
+	if !errors.As(err, &e) || e.Pos != (Position{"File.vm", 2, 3}) {
+		t.Errorf("got: %v wanted: %v", e, Position{"File.vm", 2, 3})
+	}
+}
@@ -0,0 +1,39 @@
+package parser
+
+import "strings"
+
+// Token is a single word of VM code.
+type Token struct {
+	Text string
+	// Column is the 1-based column of the first character of the token.
+	Column int
+}
+
+// isSpace reports whether c separates tokens.
+// Carriage returns are included so that files edited on Windows are accepted.
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\v' || c == '\f'
+}
+
+// Tokenize splits a line of VM code into tokens.
+// Tokens are separated by any run of whitespaces, and a comment
+// introduced by // extends to the end of the line.
+func Tokenize(line string) []Token {
+	if i := strings.Index(line, "//"); i >= 0 {
+		line = line[:i]
+	}
+
+	var tokens []Token
+	for i := 0; i < len(line); {
+		if isSpace(line[i]) {
+			i++
+			continue
+		}
+		start := i
+		for i < len(line) && !isSpace(line[i]) {
+			i++
+		}
+		tokens = append(tokens, Token{line[start:i], start + 1})
+	}
+	return tokens
+}
@@ -0,0 +1,35 @@
+package parser
+
+import "testing"
+
+type tokenizeTest struct {
+	line   string
+	tokens []Token
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []tokenizeTest{
+		{"", []Token{}},
+		{" \t\r", []Token{}},
+		{"// comment", []Token{}},
+		{"add", []Token{{"add", 1}}},
+		{"push constant 7", []Token{{"push", 1}, {"constant", 6}, {"7", 15}}},
+		{"push  constant 7", []Token{{"push", 1}, {"constant", 7}, {"7", 16}}},
+		{"\tpush\tlocal 0", []Token{{"push", 2}, {"local", 7}, {"0", 13}}},
+		{"push constant 7\r", []Token{{"push", 1}, {"constant", 6}, {"7", 15}}},
+		{"  label LOOP // comment", []Token{{"label", 3}, {"LOOP", 9}}},
+		{"if-goto END//comment", []Token{{"if-goto", 1}, {"END", 9}}},
+	}
+	for i, test := range tests {
+		tokens := Tokenize(test.line)
+		if len(tokens) != len(test.tokens) {
+			t.Errorf("#%d: got: %v wanted: %v", i, tokens, test.tokens)
+			continue
+		}
+		for j := range tokens {
+			if tokens[j] != test.tokens[j] {
+				t.Errorf("#%d-%d: got: %v wanted: %v", i, j, tokens[j], test.tokens[j])
+			}
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// MaxConstant is the largest value of the constant segment.
+	MaxConstant = 32767
+	// TempSize is the number of words of the temp segment.
+	TempSize = 8
+	// PointerSize is the number of words of the pointer segment.
+	PointerSize = 2
+	// StaticSize is the number of static variables a program can hold, shared by all of its files.
+	StaticSize = 240
+)
+
+// arithmeticCommands are the names of valid arithmetic and logical commands.
+var arithmeticCommands = map[string]bool{
+	"add": true,
+	"sub": true,
+	"neg": true,
+	"eq":  true,
+	"gt":  true,
+	"lt":  true,
+	"and": true,
+	"or":  true,
+	"not": true,
+}
+
+// IsArithmetic reports whether name is a valid arithmetic or logical command.
+func IsArithmetic(name string) bool {
+	return arithmeticCommands[name]
+}
+
+// IsIdentifier reports whether name is a valid label or function name,
+// that is a sequence of letters, digits, underscores, dots and colons not beginning with a digit.
+func IsIdentifier(name string) bool {
+	if name == "" || ('0' <= name[0] && name[0] <= '9') {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// segmentSize returns the number of valid indices of segment, or 0 if it is not bounded.
+func segmentSize(segment Segment) int {
+	switch segment {
+	case ConstantSegment:
+		return MaxConstant + 1
+	case TempSegment:
+		return TempSize
+	case PointerSegment:
+		return PointerSize
+	case StaticSegment:
+		return StaticSize
+	default:
+		return 0
+	}
+}
+
+// validateCommand checks a single command, returning nil if it is valid.
+func validateCommand(command Command) error {
+	switch command.Type {
+	case ArithmeticCommand:
+		if !IsArithmetic(command.Name) {
+			return fmt.Errorf("unknown command %q", command.Name)
+		}
+
+	case PushCommand, PopCommand:
+		if command.Type == PopCommand && command.Segment == ConstantSegment {
+			return errors.New("pop: cannot pop into the constant segment")
+		}
+		size := segmentSize(command.Segment)
+		if command.Index < 0 || (size > 0 && command.Index >= size) {
+			if size > 0 {
+				return fmt.Errorf("%s: %s index %d out of range 0-%d", command.Type, command.Segment, command.Index, size-1)
+			}
+			return fmt.Errorf("%s: negative %s index %d", command.Type, command.Segment, command.Index)
+		}
+
+	case LabelCommand, GotoCommand, IfCommand:
+		if !IsIdentifier(command.Name) {
+			return fmt.Errorf("%s: invalid label %q", command.Type, command.Name)
+		}
+
+	case FunctionCommand, CallCommand:
+		if !IsIdentifier(command.Name) {
+			return fmt.Errorf("%s: invalid function name %q", command.Type, command.Name)
+		}
+		if command.Index < 0 {
+			count := "number of locals"
+			if command.Type == CallCommand {
+				count = "number of arguments"
+			}
+			return fmt.Errorf("%s: negative %s %d", command.Type, count, command.Index)
+		}
+	}
+
+	return nil
+}
+
+// validateLabels checks that within each function of file, and within the code of file outside of functions,
+// labels are defined once and every goto and if-goto targets one of them.
+func validateLabels(file *File, errs *ErrorList) {
+	scope := "the code of " + file.Name + " outside of functions"
+	labels := make(map[string]Position)
+	var jumps []Command
+	check := func() {
+		for _, jump := range jumps {
+			if _, ok := labels[jump.Name]; !ok {
+				errs.Add(jump.Pos, fmt.Errorf("%s: label %s is not defined in %s", jump.Type, jump.Name, scope))
+			}
+		}
+	}
+
+	for _, command := range file.Commands {
+		switch command.Type {
+		case FunctionCommand:
+			check()
+			scope = "function " + command.Name
+			labels = make(map[string]Position)
+			jumps = nil
+		case LabelCommand:
+			if pos, ok := labels[command.Name]; ok {
+				errs.Add(command.Pos, fmt.Errorf("label: %s is already defined in %s at %s", command.Name, scope, pos))
+				continue
+			}
+			labels[command.Name] = command.Pos
+		case GotoCommand, IfCommand:
+			jumps = append(jumps, command)
+		}
+	}
+	check()
+}
+
+// Validate checks that the commands of files form a valid program:
+// command names, segment names, segment indices and argument counts are all checked,
+// as well as the labels of every function and the number of static variables used by the files altogether.
+// Every problem found is reported in the returned ErrorList.
+func Validate(files []*File) error {
+	var errs ErrorList
+	statics := make(map[string]bool)
+
+	for _, file := range files {
+		for _, command := range file.Commands {
+			if err := validateCommand(command); err != nil {
+				errs.Add(command.Pos, err)
+				continue
+			}
+
+			if command.Segment == StaticSegment {
+				name := fmt.Sprintf("%s.%d", file.Namespace, command.Index)
+				if !statics[name] {
+					statics[name] = true
+					if len(statics) == StaticSize+1 {
+						errs.Add(command.Pos, fmt.Errorf("too many static variables: at most %d are available", StaticSize))
+					}
+				}
+			}
+		}
+		validateLabels(file, &errs)
+	}
+
+	errs.Sort()
+	return errs.Err()
+}
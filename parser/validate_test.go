@@ -0,0 +1,129 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type isIdentifierTest struct {
+	name string
+	out  bool
+}
+
+func TestIsIdentifier(t *testing.T) {
+	tests := []isIdentifierTest{
+		{"LOOP", true},
+		{"Main.main", true},
+		{"IF_TRUE0", true},
+		{"a:b", true},
+		{"_start", true},
+		{"", false},
+		{"1abc", false},
+		{"a-b", false},
+		{"a$b", false},
+	}
+	for i, test := range tests {
+		if IsIdentifier(test.name) != test.out {
+			t.Errorf("#%d: got: %v wanted: %v", i, IsIdentifier(test.name), test.out)
+		}
+	}
+}
+
+type validateTest struct {
+	source string
+	errs   []string
+}
+
+func TestValidate(t *testing.T) {
+	tests := []validateTest{
+		{"push constant 7\npush constant 8\nadd", []string{}},
+		{"push constant 0\npush constant 32767\npop temp 0\npop temp 7\npush pointer 0\npop pointer 1", []string{}},
+		{"push local 200\npop argument 3\npush this 0\npop that 9\npush static 239", []string{}},
+		{"function Main.main 0\ncall Math.multiply 2\nlabel IF_TRUE0\ngoto IF_TRUE0\nif-goto a:b\nlabel a:b\nreturn", []string{}},
+		{"label LOOP\ngoto LOOP\nfunction Main.main 0\nlabel LOOP\ngoto LOOP\nfunction Main.f 0\nlabel LOOP\nreturn", []string{}},
+		{"add\nsub\nneg\neq\ngt\nlt\nand\nor\nnot", []string{}},
+		{"foo", []string{`Test.vm:1:1: unknown command "foo"`}},
+		{"pop constant 3", []string{"Test.vm:1:1: pop: cannot pop into the constant segment"}},
+		{"push constant 32768", []string{"Test.vm:1:1: push: constant index 32768 out of range 0-32767"}},
+		{"push temp 8", []string{"Test.vm:1:1: push: temp index 8 out of range 0-7"}},
+		{"pop pointer 2", []string{"Test.vm:1:1: pop: pointer index 2 out of range 0-1"}},
+		{"push static 240", []string{"Test.vm:1:1: push: static index 240 out of range 0-239"}},
+		{"push local -1", []string{"Test.vm:1:1: push: negative local index -1"}},
+		{"label 1abc", []string{`Test.vm:1:1: label: invalid label "1abc"`}},
+		{"function Main-main 0", []string{`Test.vm:1:1: function: invalid function name "Main-main"`}},
+		{"function Main.main -1", []string{"Test.vm:1:1: function: negative number of locals -1"}},
+		{"call Main.main -2", []string{"Test.vm:1:1: call: negative number of arguments -2"}},
+		{"goto END", []string{"Test.vm:1:1: goto: label END is not defined in the code of Test.vm outside of functions"}},
+		{
+			"function Main.main 0\nlabel LOOP\nfunction Main.f 0\nif-goto LOOP\nreturn",
+			[]string{"Test.vm:4:1: if-goto: label LOOP is not defined in function Main.f"},
+		},
+		{
+			"function Main.main 0\nlabel LOOP\npush constant 0\nlabel LOOP\nreturn",
+			[]string{"Test.vm:4:1: label: LOOP is already defined in function Main.main at Test.vm:2:1"},
+		},
+		{
+			"push temp 9\nfoo\n\npop pointer 5",
+			[]string{
+				"Test.vm:1:1: push: temp index 9 out of range 0-7",
+				`Test.vm:2:1: unknown command "foo"`,
+				"Test.vm:4:1: pop: pointer index 5 out of range 0-1",
+			},
+		},
+	}
+	for i, test := range tests {
+		file, err := ParseFile("Test.vm", strings.NewReader(test.source))
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		checkErrors(t, i, Validate([]*File{file}), test.errs)
+	}
+}
+
+func TestValidateStatics(t *testing.T) {
+	var files []*File
+	for _, namespace := range []string{"A", "B", "C"} {
+		var source []string
+		for i := 0; i < 80; i++ {
+			source = append(source, fmt.Sprintf("push static %d", i))
+		}
+		source = append(source, "push static 0")
+		file, err := ParseFile(namespace+".vm", strings.NewReader(strings.Join(source, "\n")))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		files = append(files, file)
+	}
+	checkErrors(t, 0, Validate(files), []string{})
+
+	extra, err := ParseFile("D.vm", strings.NewReader("push constant 1\npop static 0\npush static 0"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	checkErrors(t, 1, Validate(append(files, extra)), []string{
+		"D.vm:2:1: too many static variables: at most 240 are available",
+	})
+}
+
+// checkErrors reports a test failure unless err is an ErrorList holding exactly the messages in expected.
+func checkErrors(t *testing.T, i int, err error, expected []string) {
+	t.Helper()
+	var errs ErrorList
+	if err != nil {
+		var ok bool
+		if errs, ok = err.(ErrorList); !ok {
+			t.Errorf("#%d: got: %T wanted: ErrorList", i, err)
+			return
+		}
+	}
+	if len(errs) != len(expected) {
+		t.Errorf("#%d: got: %v wanted: %v", i, err, expected)
+		return
+	}
+	for j := range errs {
+		if errs[j].Error() != expected[j] {
+			t.Errorf("#%d-%d: got: %v wanted: %v", i, j, errs[j].Error(), expected[j])
+		}
+	}
+}
@@ -0,0 +1,13 @@
+// Test script for FibonacciElement: runs the translation of the program and compares
+// the final state of the memory to FibonacciElement.cmp.
+
+load FibonacciElement.asm,
+output-file FibonacciElement.out,
+compare-to FibonacciElement.cmp,
+output-list RAM[0]%D1.6.1 RAM[261]%D1.6.1;
+
+repeat 6000 {
+  ticktock;
+}
+
+output;
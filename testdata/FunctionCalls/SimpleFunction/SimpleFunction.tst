@@ -0,0 +1,27 @@
+// Test script for SimpleFunction: runs the translation of the program and compares
+// the final state of the memory to SimpleFunction.cmp.
+// The program has no Sys.init, so the script sets up the frame of a call to SimpleFunction.test.
+
+load SimpleFunction.asm,
+output-file SimpleFunction.out,
+compare-to SimpleFunction.cmp,
+output-list RAM[0]%D1.6.1 RAM[1]%D1.6.1 RAM[2]%D1.6.1 RAM[3]%D1.6.1 RAM[4]%D1.6.1 RAM[310]%D1.6.1;
+
+set RAM[0] 317, // the stack pointer
+set RAM[1] 317, // the base of the local segment
+set RAM[2] 310, // the base of the argument segment
+set RAM[3] 3000, // the base of the this segment
+set RAM[4] 4000, // the base of the that segment
+set RAM[310] 1234, // argument 0
+set RAM[311] 37, // argument 1
+set RAM[312] 1000, // the frame of the caller: return address
+set RAM[313] 305, // saved LCL
+set RAM[314] 300, // saved ARG
+set RAM[315] 3010, // saved THIS
+set RAM[316] 4010, // saved THAT
+
+repeat 300 {
+  ticktock;
+}
+
+output;
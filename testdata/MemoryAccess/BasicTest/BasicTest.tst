@@ -0,0 +1,19 @@
+// Test script for BasicTest: runs the translation of the program and compares
+// the final state of the memory to BasicTest.cmp.
+
+load BasicTest.asm,
+output-file BasicTest.out,
+compare-to BasicTest.cmp,
+output-list RAM[256]%D1.6.1 RAM[300]%D1.6.1 RAM[401]%D1.6.1 RAM[402]%D1.6.1 RAM[3006]%D1.6.1 RAM[3012]%D1.6.1 RAM[3015]%D1.6.1 RAM[11]%D1.6.1;
+
+set RAM[0] 256, // the stack pointer
+set RAM[1] 300, // the base of the local segment
+set RAM[2] 400, // the base of the argument segment
+set RAM[3] 3000, // the base of the this segment
+set RAM[4] 3010, // the base of the that segment
+
+repeat 600 {
+  ticktock;
+}
+
+output;
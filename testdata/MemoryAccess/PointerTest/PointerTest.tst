@@ -0,0 +1,15 @@
+// Test script for PointerTest: runs the translation of the program and compares
+// the final state of the memory to PointerTest.cmp.
+
+load PointerTest.asm,
+output-file PointerTest.out,
+compare-to PointerTest.cmp,
+output-list RAM[256]%D1.6.1 RAM[3]%D1.6.1 RAM[4]%D1.6.1 RAM[3032]%D1.6.1 RAM[3046]%D1.6.1;
+
+set RAM[0] 256, // the stack pointer
+
+repeat 450 {
+  ticktock;
+}
+
+output;
@@ -0,0 +1,15 @@
+// Test script for StaticTest: runs the translation of the program and compares
+// the final state of the memory to StaticTest.cmp.
+
+load StaticTest.asm,
+output-file StaticTest.out,
+compare-to StaticTest.cmp,
+output-list RAM[256]%D1.6.1;
+
+set RAM[0] 256, // the stack pointer
+
+repeat 200 {
+  ticktock;
+}
+
+output;
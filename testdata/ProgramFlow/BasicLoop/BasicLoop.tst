@@ -0,0 +1,18 @@
+// Test script for BasicLoop: runs the translation of the program and compares
+// the final state of the memory to BasicLoop.cmp.
+
+load BasicLoop.asm,
+output-file BasicLoop.out,
+compare-to BasicLoop.cmp,
+output-list RAM[0]%D1.6.1 RAM[256]%D1.6.1;
+
+set RAM[0] 256, // the stack pointer
+set RAM[1] 300, // the base of the local segment
+set RAM[2] 400, // the base of the argument segment
+set RAM[400] 3, // argument 0
+
+repeat 600 {
+  ticktock;
+}
+
+output;
@@ -0,0 +1,19 @@
+// Test script for FibonacciSeries: runs the translation of the program and compares
+// the final state of the memory to FibonacciSeries.cmp.
+
+load FibonacciSeries.asm,
+output-file FibonacciSeries.out,
+compare-to FibonacciSeries.cmp,
+output-list RAM[3000]%D1.6.1 RAM[3001]%D1.6.1 RAM[3002]%D1.6.1 RAM[3003]%D1.6.1 RAM[3004]%D1.6.1 RAM[3005]%D1.6.1;
+
+set RAM[0] 256, // the stack pointer
+set RAM[1] 300, // the base of the local segment
+set RAM[2] 400, // the base of the argument segment
+set RAM[400] 6, // argument 0: the number of elements
+set RAM[401] 3000, // argument 1: where to store them
+
+repeat 1100 {
+  ticktock;
+}
+
+output;
@@ -0,0 +1,15 @@
+// Test script for SimpleAdd: runs the translation of the program and compares
+// the final state of the memory to SimpleAdd.cmp.
+
+load SimpleAdd.asm,
+output-file SimpleAdd.out,
+compare-to SimpleAdd.cmp,
+output-list RAM[0]%D2.6.2 RAM[256]%D2.6.2;
+
+set RAM[0] 256, // the stack pointer
+
+repeat 60 {
+  ticktock;
+}
+
+output;
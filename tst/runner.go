@@ -0,0 +1,363 @@
+package tst
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sato11/the-hack-vm-translator/assembler"
+	"github.com/sato11/the-hack-vm-translator/codewriter"
+	"github.com/sato11/the-hack-vm-translator/emulator"
+	"github.com/sato11/the-hack-vm-translator/parser"
+)
+
+// column describes a column of the output list, such as RAM[256]%D2.6.2.
+type column struct {
+	name    string
+	address int // the RAM address, or -1 for a register
+	format  byte
+	left    int
+	width   int
+	right   int
+}
+
+// parseColumn parses a column of an output-list command.
+func parseColumn(s string) (column, error) {
+	i := strings.IndexByte(s, '%')
+	if i < 0 {
+		return column{}, fmt.Errorf("missing format in %q", s)
+	}
+	c := column{name: s[:i], address: -1}
+
+	switch {
+	case c.name == "PC" || c.name == "A" || c.name == "D":
+	case strings.HasPrefix(c.name, "RAM[") && strings.HasSuffix(c.name, "]"):
+		address, err := strconv.Atoi(c.name[4 : len(c.name)-1])
+		if err != nil || address < 0 || address >= emulator.RAMSize {
+			return column{}, fmt.Errorf("invalid address in %q", s)
+		}
+		c.address = address
+	default:
+		return column{}, fmt.Errorf("unknown variable %q", c.name)
+	}
+
+	spec := s[i+1:]
+	if spec == "" || !strings.ContainsRune("DXB", rune(spec[0])) {
+		return column{}, fmt.Errorf("invalid format in %q", s)
+	}
+	c.format = spec[0]
+	widths := strings.Split(spec[1:], ".")
+	if len(widths) != 3 {
+		return column{}, fmt.Errorf("invalid format in %q", s)
+	}
+	for j, p := range []*int{&c.left, &c.width, &c.right} {
+		n, err := strconv.Atoi(widths[j])
+		if err != nil || n < 0 {
+			return column{}, fmt.Errorf("invalid format in %q", s)
+		}
+		*p = n
+	}
+	return c, nil
+}
+
+// header returns the name of the column centered within its cell.
+func (c column) header() string {
+	size := c.left + c.width + c.right
+	name := c.name
+	if len(name) > size {
+		name = name[:size]
+	}
+	left := (size - len(name)) / 2
+	return strings.Repeat(" ", left) + name + strings.Repeat(" ", size-left-len(name))
+}
+
+// cell returns value formatted within the cell of the column.
+func (c column) cell(value int16) string {
+	var s string
+	switch c.format {
+	case 'X':
+		s = fmt.Sprintf("%04X", uint16(value))
+	case 'B':
+		s = fmt.Sprintf("%016b", uint16(value))
+	default:
+		s = strconv.Itoa(int(value))
+	}
+	if len(s) > c.width {
+		s = s[len(s)-c.width:]
+	}
+	return strings.Repeat(" ", c.left) + fmt.Sprintf("%*s", c.width, s) + strings.Repeat(" ", c.right)
+}
+
+// Loader returns the program to load for the file name given to a load command.
+type Loader func(name string) (*assembler.Program, error)
+
+// Translator returns a Loader which translates the .vm files directly inside dir, in lexical order,
+// whatever name is loaded. Bootstrap code is emitted as by codewriter.BootstrapAuto.
+// configure, if not nil, is applied to the code writer before the translation.
+func Translator(dir string, configure func(*codewriter.CodeWriter)) Loader {
+	return func(name string) (*assembler.Program, error) {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.vm"))
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("%s: no .vm files found", dir)
+		}
+
+		var files []*parser.File
+		for _, path := range paths {
+			f, err := os.Open(path)
+			if err != nil {
+				return nil, err
+			}
+			file, err := parser.ParseFile(path, f)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, file)
+		}
+		if err := parser.Validate(files); err != nil {
+			return nil, err
+		}
+
+		var asm bytes.Buffer
+		w := codewriter.NewWriter(&asm)
+		if configure != nil {
+			configure(w)
+		}
+		if err := w.WriteProgram(files, codewriter.BootstrapAuto); err != nil {
+			return nil, err
+		}
+		if err := w.Flush(); err != nil {
+			return nil, err
+		}
+		return assembler.Assemble(name, &asm)
+	}
+}
+
+// ComparisonError is returned by Run when a line of the output differs from the compare file.
+type ComparisonError struct {
+	// Line is the 1-based line of the compare file.
+	Line      int
+	Got, Want string
+}
+
+func (e *ComparisonError) Error() string {
+	return fmt.Sprintf("tst: comparison failure at line %d: got %s, want %s", e.Line, e.Got, e.Want)
+}
+
+// Runner executes test scripts on the emulator.
+type Runner struct {
+	// Dir is the directory compare files are read from.
+	Dir string
+	// Load provides the programs loaded by the scripts.
+	Load Loader
+	// Output, if not nil, receives the lines the scripts output.
+	Output io.Writer
+
+	computer *emulator.Computer
+	columns  []column
+	compare  []string
+	lines    int
+}
+
+// cells splits a line of an output table into its trimmed cells.
+func cells(line string) []string {
+	fields := strings.Split(strings.Trim(strings.TrimSpace(line), "|"), "|")
+	for i, field := range fields {
+		fields[i] = strings.TrimSpace(field)
+	}
+	return fields
+}
+
+// matches reports whether the output line got matches the line want of a compare file,
+// where a cell of asterisks matches anything.
+func matches(got, want string) bool {
+	g, w := cells(got), cells(want)
+	if len(g) != len(w) {
+		return false
+	}
+	for i := range g {
+		if g[i] != w[i] && strings.Trim(w[i], "*") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// output writes a line of the output table and compares it to the compare file.
+func (r *Runner) output(line string) error {
+	if r.Output != nil {
+		if _, err := fmt.Fprintln(r.Output, line); err != nil {
+			return err
+		}
+	}
+
+	r.lines++
+	if r.compare == nil {
+		return nil
+	}
+	if r.lines > len(r.compare) {
+		return &ComparisonError{r.lines, line, "end of file"}
+	}
+	if want := r.compare[r.lines-1]; !matches(line, want) {
+		return &ComparisonError{r.lines, line, want}
+	}
+	return nil
+}
+
+// value returns the current value of the variable shown in c.
+func (r *Runner) value(c column) int16 {
+	switch c.name {
+	case "PC":
+		return int16(r.computer.PC)
+	case "A":
+		return r.computer.A
+	case "D":
+		return r.computer.D
+	}
+	return r.computer.Peek(c.address)
+}
+
+// set assigns value to the variable target, one of RAM[n], PC, A and D.
+func (r *Runner) set(target, value string) error {
+	n, err := strconv.ParseInt(value, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid value %q", value)
+	}
+	c, err := parseColumn(target + "%D1.1.1")
+	if err != nil {
+		return err
+	}
+	switch c.name {
+	case "PC":
+		r.computer.Reset()
+		r.computer.PC = int(n)
+	case "A":
+		r.computer.A = int16(n)
+	case "D":
+		r.computer.D = int16(n)
+	default:
+		r.computer.Poke(c.address, int16(n))
+	}
+	return nil
+}
+
+// readCompare reads the lines of the compare file name.
+func (r *Runner) readCompare(name string) error {
+	f, err := os.Open(filepath.Join(r.Dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r.compare = []string{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" {
+			r.compare = append(r.compare, line)
+		}
+	}
+	return s.Err()
+}
+
+// execute runs commands one after another.
+func (r *Runner) execute(commands []command) error {
+	for _, c := range commands {
+		if r.computer == nil && c.name != "load" && c.name != "output-file" && c.name != "compare-to" &&
+			c.name != "output-list" && c.name != "echo" && c.name != "clear-echo" {
+			return fmt.Errorf("line %d: %s: no program loaded", c.line, c.name)
+		}
+
+		var err error
+		switch c.name {
+		case "load":
+			var program *assembler.Program
+			if program, err = r.Load(c.args[0]); err == nil {
+				r.computer = emulator.New(program)
+			}
+		case "compare-to":
+			err = r.readCompare(c.args[0])
+		case "output-list":
+			r.columns = nil
+			headers := make([]string, len(c.args))
+			for i, arg := range c.args {
+				column, _ := parseColumn(arg)
+				r.columns = append(r.columns, column)
+				headers[i] = column.header()
+			}
+			err = r.output("|" + strings.Join(headers, "|") + "|")
+		case "set":
+			err = r.set(c.args[0], c.args[1])
+		case "repeat":
+			n, _ := strconv.Atoi(c.args[0])
+			for i := 0; i < n && err == nil; i++ {
+				err = r.execute(c.body)
+			}
+			if err != nil {
+				return err
+			}
+		case "ticktock":
+			if !r.computer.Halted() {
+				err = r.computer.Step()
+			}
+		case "output":
+			values := make([]string, len(r.columns))
+			for i, column := range r.columns {
+				values[i] = column.cell(r.value(column))
+			}
+			err = r.output("|" + strings.Join(values, "|") + "|")
+		}
+		// output-file, echo and clear-echo have no effect: the output goes to r.Output.
+
+		if err != nil {
+			if _, ok := err.(*ComparisonError); ok || c.name == "repeat" {
+				return err
+			}
+			return fmt.Errorf("line %d: %s: %v", c.line, c.name, err)
+		}
+	}
+	return nil
+}
+
+// Run executes script, comparing each line it outputs to the compare file named by compare-to, if any.
+func (r *Runner) Run(script *Script) error {
+	r.computer = nil
+	r.columns = nil
+	r.compare = nil
+	r.lines = 0
+
+	if err := r.execute(script.commands); err != nil {
+		return err
+	}
+	if r.compare != nil && r.lines < len(r.compare) {
+		return &ComparisonError{r.lines + 1, "end of output", r.compare[r.lines]}
+	}
+	return nil
+}
+
+// RunFile parses and runs the test script at path, reading compare files next to it
+// and loading programs with load.
+func RunFile(path string, load Loader) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	script, err := Parse(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	r := &Runner{Dir: filepath.Dir(path), Load: load}
+	if err := r.Run(script); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package tst
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// command is a single command of a test script.
+type command struct {
+	name string
+	args []string
+	// body holds the commands repeated by a repeat command.
+	body []command
+	line int
+}
+
+// Script is a parsed test script.
+type Script struct {
+	commands []command
+}
+
+// token is a word or punctuation of a test script.
+type token struct {
+	text string
+	line int
+}
+
+// tokenize splits a test script into tokens, leaving comments out.
+func tokenize(source string) []token {
+	var tokens []token
+	line := 1
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case strings.HasPrefix(source[i:], "//"):
+			for i < len(source) && source[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(source[i:], "/*"):
+			end := strings.Index(source[i+2:], "*/")
+			if end < 0 {
+				end = len(source) - i - 4
+			}
+			line += strings.Count(source[i:i+end+4], "\n")
+			i += end + 4
+		case c == ',' || c == ';' || c == '!' || c == '{' || c == '}':
+			tokens = append(tokens, token{string(c), line})
+			i++
+		case c == '"':
+			end := strings.IndexByte(source[i+1:], '"')
+			if end < 0 {
+				end = len(source) - i - 2
+			}
+			tokens = append(tokens, token{source[i : i+end+2], line})
+			i += end + 2
+		default:
+			start := i
+			for i < len(source) && !strings.ContainsRune(" \t\r\n,;!{}", rune(source[i])) {
+				i++
+			}
+			tokens = append(tokens, token{source[start:i], line})
+		}
+	}
+	return tokens
+}
+
+// parseCommands parses tokens into commands until the end of the tokens or a closing brace,
+// returning the commands along with the tokens left.
+func parseCommands(tokens []token) ([]command, []token, error) {
+	var commands []command
+	for len(tokens) != 0 {
+		t := tokens[0]
+		switch t.text {
+		case "}":
+			return commands, tokens, nil
+		case ",", ";", "!":
+			tokens = tokens[1:]
+			continue
+		}
+
+		c := command{name: t.text, line: t.line}
+		tokens = tokens[1:]
+		for len(tokens) != 0 && !strings.Contains(",;!{}", tokens[0].text) {
+			c.args = append(c.args, tokens[0].text)
+			tokens = tokens[1:]
+		}
+
+		if c.name == "repeat" {
+			if len(tokens) == 0 || tokens[0].text != "{" {
+				return nil, nil, fmt.Errorf("line %d: repeat: missing {", t.line)
+			}
+			body, rest, err := parseCommands(tokens[1:])
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(rest) == 0 {
+				return nil, nil, fmt.Errorf("line %d: repeat: missing }", t.line)
+			}
+			c.body = body
+			tokens = rest[1:]
+		}
+
+		if err := checkCommand(c); err != nil {
+			return nil, nil, err
+		}
+		commands = append(commands, c)
+	}
+	return commands, tokens, nil
+}
+
+// checkCommand reports an error unless c is a supported command with valid arguments.
+func checkCommand(c command) error {
+	want := -1
+	switch c.name {
+	case "load", "output-file", "compare-to", "echo":
+		want = 1
+	case "set":
+		want = 2
+	case "repeat":
+		if len(c.args) != 1 {
+			return fmt.Errorf("line %d: repeat: missing count", c.line)
+		}
+		if n, err := strconv.Atoi(c.args[0]); err != nil || n < 0 {
+			return fmt.Errorf("line %d: repeat: invalid count %q", c.line, c.args[0])
+		}
+		return nil
+	case "ticktock", "output", "clear-echo":
+		want = 0
+	case "output-list":
+		for _, arg := range c.args {
+			if _, err := parseColumn(arg); err != nil {
+				return fmt.Errorf("line %d: output-list: %v", c.line, err)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("line %d: unknown command %q", c.line, c.name)
+	}
+
+	if len(c.args) != want {
+		return fmt.Errorf("line %d: %s: wrong number of arguments", c.line, c.name)
+	}
+	return nil
+}
+
+// Parse reads a test script written in the test script language of the Nand2Tetris tools.
+// The commands load, output-file, compare-to, output-list, set, repeat, ticktock, output,
+// echo and clear-echo are supported.
+func Parse(r io.Reader) (*Script, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	commands, rest, err := parseCommands(tokenize(string(b)))
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("line %d: unexpected }", rest[0].line)
+	}
+	return &Script{commands}, nil
+}
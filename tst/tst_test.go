@@ -0,0 +1,171 @@
+package tst
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sato11/the-hack-vm-translator/assembler"
+	"github.com/sato11/the-hack-vm-translator/codewriter"
+)
+
+func TestFixtures(t *testing.T) {
+	scripts, err := filepath.Glob(filepath.Join("..", "testdata", "*", "*", "*.tst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scripts) == 0 {
+		t.Fatal("no test scripts found")
+	}
+	modes := map[string]func(*codewriter.CodeWriter){
+		"inline":    nil,
+		"shared":    func(w *codewriter.CodeWriter) { w.SetSharedRoutines(true) },
+		"optimized": func(w *codewriter.CodeWriter) { w.SetOptimize(true) },
+	}
+	for _, script := range scripts {
+		for mode, configure := range modes {
+			t.Run(strings.TrimSuffix(filepath.Base(script), ".tst")+"/"+mode, func(t *testing.T) {
+				if err := RunFile(script, Translator(filepath.Dir(script), configure)); err != nil {
+					t.Error(err)
+				}
+			})
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		script string
+		err    string
+	}{
+		{"load Foo.asm, /* comment\n spanning lines */ output;", ""},
+		{"repeat 3 { ticktock; } output;", ""},
+		{"echo \"a message, with a comma\";", ""},
+		{"output-list RAM[0]%D1.6.1 PC%X1.4.1 D%B1.16.1;", ""},
+		{"tick;", `line 1: unknown command "tick"`},
+		{"\nrepeat { ticktock; }", "line 2: repeat: missing count"},
+		{"repeat 3 ticktock;", "line 1: repeat: missing {"},
+		{"repeat 3 { ticktock;", "line 1: repeat: missing }"},
+		{"output; }", "line 1: unexpected }"},
+		{"set RAM[0];", "line 1: set: wrong number of arguments"},
+		{"output-list RAM[0];", `line 1: output-list: missing format in "RAM[0]"`},
+		{"output-list R0%D1.6.1;", `line 1: output-list: unknown variable "R0"`},
+		{"output-list RAM[0]%S1.6.1;", `line 1: output-list: invalid format in "RAM[0]%S1.6.1"`},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse(strings.NewReader(tt.script))
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.err {
+			t.Errorf("%q: got: %v wanted: %v", tt.script, got, tt.err)
+		}
+	}
+}
+
+func TestColumn(t *testing.T) {
+	tests := []struct {
+		spec   string
+		value  int16
+		header string
+		cell   string
+	}{
+		{"RAM[0]%D2.6.2", 257, "  RAM[0]  ", "     257  "},
+		{"RAM[256]%D2.6.2", -1, " RAM[256] ", "      -1  "},
+		{"RAM[3]%D1.6.1", 3030, " RAM[3] ", "   3030 "},
+		{"A%X1.4.1", -1, "  A   ", " FFFF "},
+		{"D%B0.16.0", 5, "       D        ", "0000000000000101"},
+	}
+
+	for _, tt := range tests {
+		c, err := parseColumn(tt.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.header(); got != tt.header {
+			t.Errorf("header of %s: got: %v wanted: %v", tt.spec, got, tt.header)
+		}
+		if got := c.cell(tt.value); got != tt.cell {
+			t.Errorf("cell of %s with %d: got: %v wanted: %v", tt.spec, tt.value, got, tt.cell)
+		}
+	}
+}
+
+// load returns a Loader which assembles source, whatever name is loaded.
+func load(source string) Loader {
+	return func(name string) (*assembler.Program, error) {
+		return assembler.Assemble(name, strings.NewReader(source))
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cmp := "|  RAM[0]  |   D    |\n|       2  |   *    |\n|       4  |   *    |\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "Double.cmp"), []byte(cmp), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Double doubles RAM[0] at every run.
+	double := "@R0\nD=M\nM=D+M\n(END)\n@END\n0;JMP\n"
+	tests := []struct {
+		script string
+		err    string
+		output string
+	}{
+		{
+			script: "load Double.asm, compare-to Double.cmp, output-list RAM[0]%D2.6.2 D%D1.6.1;\n" +
+				"set RAM[0] 1, repeat 10 { ticktock; } output;\nset PC 0, repeat 10 { ticktock; } output;",
+			output: "|  RAM[0]  |   D    |\n|       2  |      1 |\n|       4  |      2 |\n",
+		},
+		{
+			script: "load Double.asm, compare-to Double.cmp, output-list RAM[0]%D2.6.2 D%D1.6.1;\n" +
+				"set RAM[0] 1, repeat 10 { ticktock; } output;\nrepeat 10 { ticktock; } output;",
+			err:    "tst: comparison failure at line 3: got |       2  |      1 |, want |       4  |   *    |",
+			output: "|  RAM[0]  |   D    |\n|       2  |      1 |\n|       2  |      1 |\n",
+		},
+		{
+			script: "load Double.asm, compare-to Double.cmp, output-list RAM[0]%D2.6.2 D%D1.6.1;\n" +
+				"set RAM[0] 1, repeat 10 { ticktock; } output;",
+			err:    "tst: comparison failure at line 3: got end of output, want |       4  |   *    |",
+			output: "|  RAM[0]  |   D    |\n|       2  |      1 |\n",
+		},
+		{
+			script: "output;",
+			err:    "line 1: output: no program loaded",
+		},
+		{
+			script: "load Double.asm,\nset RAM[0] 40000;",
+			err:    `line 2: set: invalid value "40000"`,
+		},
+	}
+
+	for _, tt := range tests {
+		script, err := Parse(strings.NewReader(tt.script))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var output bytes.Buffer
+		r := &Runner{Dir: dir, Load: load(double), Output: &output}
+		err = r.Run(script)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.err {
+			t.Errorf("%q: got: %v wanted: %v", tt.script, got, tt.err)
+		}
+		if output.String() != tt.output {
+			t.Errorf("%q: output: got: %v wanted: %v", tt.script, output.String(), tt.output)
+		}
+	}
+}
@@ -0,0 +1,539 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sato11/the-hack-vm-translator/parser"
+)
+
+// RAMSize is the number of words of the memory the machine works on.
+const RAMSize = 32768
+
+// Addresses of the registers and segments mapped onto the memory, as on the Hack platform.
+const (
+	SP = iota
+	LCL
+	ARG
+	THIS
+	THAT
+	// TempBase is the address of the temp segment.
+	TempBase = 5
+	// PointerBase is the address of the pointer segment, that is of THIS and THAT.
+	PointerBase = THIS
+	// StackBase is the address the stack begins at.
+	StackBase = 256
+)
+
+// ErrHalted is returned by Step when the machine has halted.
+var ErrHalted = errors.New("vm: halted")
+
+// StepLimitError is returned by RunUntilHalt when the program does not halt in time.
+type StepLimitError struct {
+	Limit int
+}
+
+func (e *StepLimitError) Error() string {
+	return fmt.Sprintf("vm: program did not halt within %d steps", e.Limit)
+}
+
+// AddressError is returned when a command accesses memory out of the RAM.
+type AddressError struct {
+	Address int
+}
+
+func (e *AddressError) Error() string {
+	return fmt.Sprintf("vm: RAM[%d] out of range", e.Address)
+}
+
+// UndefinedFunctionError is returned when a command calls a function no file defines.
+type UndefinedFunctionError struct {
+	Function string
+}
+
+func (e *UndefinedFunctionError) Error() string {
+	return fmt.Sprintf("vm: call to undefined function %s", e.Function)
+}
+
+// instruction is a command of the program along with what it needs at run time.
+type instruction struct {
+	parser.Command
+	namespace string
+	// target is the index of the label a goto or if-goto command jumps to.
+	target int
+}
+
+// Machine executes VM commands directly, without translating them.
+// Its memory is laid out as on the Hack platform, except for static variables which are kept
+// per namespace apart from the RAM.
+type Machine struct {
+	// RAM is the memory holding the registers, the temp segment, the stack and the heap.
+	RAM [RAMSize]int16
+	// PC is the index of the next command to execute.
+	PC int
+	// Steps counts the commands executed so far.
+	Steps int
+
+	program     []instruction
+	functions   map[string]int
+	statics     map[string]int16
+	breakpoints map[int]bool
+	// calls holds the addresses of the return addresses of the calls in progress.
+	calls  []int
+	halted bool
+}
+
+// labelName returns the name a label is known by in the scope of function, or of the code of namespace
+// outside of functions if function is empty, as in the translation.
+func labelName(function, namespace, label string) string {
+	if function == "" {
+		return fmt.Sprintf("%s$$%s", namespace, label)
+	}
+	return fmt.Sprintf("%s$%s", function, label)
+}
+
+// New loads files as a single program into a new machine, whose stack pointer is set to StackBase.
+// Execution starts at the first command of the first file; call Bootstrap to start with Sys.init instead.
+// Labels are scoped by function, or by file outside of functions, as in the translation, and a goto
+// to a label not defined in its scope is reported in the returned parser.ErrorList,
+// as is a function defined more than once.
+func New(files []*parser.File) (*Machine, error) {
+	m := &Machine{
+		functions:   make(map[string]int),
+		statics:     make(map[string]int16),
+		breakpoints: make(map[int]bool),
+	}
+	m.RAM[SP] = StackBase
+
+	var errs parser.ErrorList
+	labels := make(map[string]int)
+	// targets holds the scoped names of the labels gotos jump to, by the index of the goto
+	targets := make(map[int]string)
+	for _, file := range files {
+		function := ""
+		for _, command := range file.Commands {
+			switch command.Type {
+			case parser.FunctionCommand:
+				function = command.Name
+				if _, ok := m.functions[function]; ok {
+					errs.Add(command.Pos, fmt.Errorf("function %s defined more than once", function))
+				}
+				m.functions[function] = len(m.program)
+			case parser.LabelCommand:
+				labels[labelName(function, file.Namespace, command.Name)] = len(m.program)
+			case parser.GotoCommand, parser.IfCommand:
+				targets[len(m.program)] = labelName(function, file.Namespace, command.Name)
+			}
+			m.program = append(m.program, instruction{command, file.Namespace, -1})
+		}
+	}
+
+	for i := range m.program {
+		in := &m.program[i]
+		if name, ok := targets[i]; ok {
+			target, ok := labels[name]
+			if !ok {
+				errs.Add(in.Pos, fmt.Errorf("%s: undefined label %s", in.Type, in.Name))
+			}
+			in.target = target
+		}
+	}
+
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Defines reports whether the program defines the function named function.
+func (m *Machine) Defines(function string) bool {
+	_, ok := m.functions[function]
+	return ok
+}
+
+// Bootstrap does what the bootstrap code of the translation does:
+// it sets the stack pointer to StackBase and calls entry, usually Sys.init.
+// The program halts when entry returns.
+func (m *Machine) Bootstrap(entry string) error {
+	m.RAM[SP] = StackBase
+	m.PC = len(m.program)
+	m.calls = nil
+	m.halted = false
+	return m.call(entry, 0)
+}
+
+// Halted reports whether the program has come to an end,
+// either by running past its last command or by entering a loop that jumps onto itself,
+// as in label END / goto END.
+func (m *Machine) Halted() bool {
+	return m.halted || m.PC < 0 || m.PC >= len(m.program)
+}
+
+// Command returns the next command to execute. It must not be called once the machine has halted.
+func (m *Machine) Command() parser.Command {
+	return m.program[m.PC].Command
+}
+
+// Namespace returns the namespace of the next command to execute.
+// It must not be called once the machine has halted.
+func (m *Machine) Namespace() string {
+	return m.program[m.PC].namespace
+}
+
+// Function returns the name of the function the next command belongs to,
+// or "" if it comes before any function.
+func (m *Machine) Function() string {
+	for i := m.PC; i >= 0; i-- {
+		if i < len(m.program) && m.program[i].Type == parser.FunctionCommand {
+			return m.program[i].Name
+		}
+	}
+	return ""
+}
+
+// Peek returns the value of RAM[address].
+func (m *Machine) Peek(address int) int16 {
+	return m.RAM[address]
+}
+
+// Poke sets RAM[address] to value.
+func (m *Machine) Poke(address int, value int16) {
+	m.RAM[address] = value
+}
+
+// Static returns the value of the static variable index of namespace.
+func (m *Machine) Static(namespace string, index int) int16 {
+	return m.statics[staticName(namespace, index)]
+}
+
+// Statics returns the values of the static variables used so far, by their names in the translation,
+// such as Main.0.
+func (m *Machine) Statics() map[string]int16 {
+	statics := make(map[string]int16, len(m.statics))
+	for name, value := range m.statics {
+		statics[name] = value
+	}
+	return statics
+}
+
+// Stack returns the values on the stack, from StackBase up to the stack pointer.
+func (m *Machine) Stack() []int16 {
+	sp := int(m.RAM[SP])
+	if sp < StackBase || sp > RAMSize {
+		return nil
+	}
+	return append([]int16(nil), m.RAM[StackBase:sp]...)
+}
+
+// ReturnAddresses returns the RAM addresses holding the return addresses of the calls in progress,
+// outermost first. Unlike the rest of the frame of a call, its return address is not a value of the
+// program: it is the index of the command to return to, where the translation has a ROM address.
+func (m *Machine) ReturnAddresses() []int {
+	return append([]int(nil), m.calls...)
+}
+
+func staticName(namespace string, index int) string {
+	return fmt.Sprintf("%s.%d", namespace, index)
+}
+
+// load returns the value at address, checking that it lies in the RAM.
+func (m *Machine) load(address int) (int16, error) {
+	if address < 0 || address >= RAMSize {
+		return 0, &AddressError{address}
+	}
+	return m.RAM[address], nil
+}
+
+// store sets the value at address, checking that it lies in the RAM.
+func (m *Machine) store(address int, value int16) error {
+	if address < 0 || address >= RAMSize {
+		return &AddressError{address}
+	}
+	m.RAM[address] = value
+	return nil
+}
+
+func (m *Machine) push(value int16) error {
+	if err := m.store(int(m.RAM[SP]), value); err != nil {
+		return err
+	}
+	m.RAM[SP]++
+	return nil
+}
+
+func (m *Machine) pop() (int16, error) {
+	m.RAM[SP]--
+	return m.load(int(m.RAM[SP]))
+}
+
+// address returns the RAM address of segment index, for any segment other than constant and static.
+func (m *Machine) address(segment parser.Segment, index int) int {
+	switch segment {
+	case parser.LocalSegment:
+		return int(m.RAM[LCL]) + index
+	case parser.ArgumentSegment:
+		return int(m.RAM[ARG]) + index
+	case parser.ThisSegment:
+		return int(m.RAM[THIS]) + index
+	case parser.ThatSegment:
+		return int(m.RAM[THAT]) + index
+	case parser.PointerSegment:
+		return PointerBase + index
+	default: // parser.TempSegment
+		return TempBase + index
+	}
+}
+
+// arithmetic pops the operands of an arithmetic or logical command and pushes its result.
+func (m *Machine) arithmetic(name string) error {
+	y, err := m.pop()
+	if err != nil {
+		return err
+	}
+
+	var result int16
+	switch name {
+	case "neg":
+		result = -y
+	case "not":
+		result = ^y
+	default:
+		x, err := m.pop()
+		if err != nil {
+			return err
+		}
+		switch name {
+		case "add":
+			result = x + y
+		case "sub":
+			result = x - y
+		case "and":
+			result = x & y
+		case "or":
+			result = x | y
+		case "eq":
+			result = truth(x == y)
+		case "gt":
+			result = truth(x > y)
+		case "lt":
+			result = truth(x < y)
+		default:
+			return fmt.Errorf("vm: unknown command %q", name)
+		}
+	}
+	return m.push(result)
+}
+
+// truth returns the VM representation of b: -1 for true and 0 for false.
+func truth(b bool) int16 {
+	if b {
+		return -1
+	}
+	return 0
+}
+
+// call pushes the frame of the caller, whose execution resumes at m.PC, and jumps to function.
+func (m *Machine) call(function string, numArgs int) error {
+	entry, ok := m.functions[function]
+	if !ok {
+		return &UndefinedFunctionError{function}
+	}
+	m.calls = append(m.calls, int(m.RAM[SP]))
+	for _, value := range []int16{int16(m.PC), m.RAM[LCL], m.RAM[ARG], m.RAM[THIS], m.RAM[THAT]} {
+		if err := m.push(value); err != nil {
+			return err
+		}
+	}
+	m.RAM[ARG] = m.RAM[SP] - int16(numArgs) - 5
+	m.RAM[LCL] = m.RAM[SP]
+	m.PC = entry
+	return nil
+}
+
+// ret pops the frame of the current function, leaving its return value in place of its arguments.
+func (m *Machine) ret() error {
+	frame := int(m.RAM[LCL])
+	var saved [5]int16
+	for i := range saved {
+		value, err := m.load(frame - 5 + i)
+		if err != nil {
+			return err
+		}
+		saved[i] = value
+	}
+
+	value, err := m.pop()
+	if err != nil {
+		return err
+	}
+	if err := m.store(int(m.RAM[ARG]), value); err != nil {
+		return err
+	}
+	m.RAM[SP] = m.RAM[ARG] + 1
+	m.RAM[THAT], m.RAM[THIS], m.RAM[ARG], m.RAM[LCL] = saved[4], saved[3], saved[2], saved[1]
+	m.PC = int(saved[0])
+	if len(m.calls) != 0 {
+		m.calls = m.calls[:len(m.calls)-1]
+	}
+	return nil
+}
+
+// execute carries out a single command, whose successor is already at m.PC.
+func (m *Machine) execute(in instruction) error {
+	switch in.Type {
+	case parser.ArithmeticCommand:
+		return m.arithmetic(in.Name)
+
+	case parser.PushCommand:
+		switch in.Segment {
+		case parser.ConstantSegment:
+			return m.push(int16(in.Index))
+		case parser.StaticSegment:
+			return m.push(m.statics[staticName(in.namespace, in.Index)])
+		}
+		value, err := m.load(m.address(in.Segment, in.Index))
+		if err != nil {
+			return err
+		}
+		return m.push(value)
+
+	case parser.PopCommand:
+		value, err := m.pop()
+		if err != nil {
+			return err
+		}
+		if in.Segment == parser.StaticSegment {
+			m.statics[staticName(in.namespace, in.Index)] = value
+			return nil
+		}
+		return m.store(m.address(in.Segment, in.Index), value)
+
+	case parser.LabelCommand:
+		return nil
+
+	case parser.GotoCommand:
+		if in.target == m.PC-2 {
+			m.halted = true
+		}
+		m.PC = in.target
+		return nil
+
+	case parser.IfCommand:
+		value, err := m.pop()
+		if err != nil {
+			return err
+		}
+		if value != 0 {
+			m.PC = in.target
+		}
+		return nil
+
+	case parser.FunctionCommand:
+		for i := 0; i < in.Index; i++ {
+			if err := m.push(0); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case parser.CallCommand:
+		return m.call(in.Name, in.Index)
+
+	case parser.ReturnCommand:
+		return m.ret()
+	}
+
+	return fmt.Errorf("vm: cannot execute command %q", in.String())
+}
+
+// Step executes a single command.
+// A returned error other than ErrHalted is a *parser.Error holding the position of the command.
+func (m *Machine) Step() error {
+	if m.Halted() {
+		return ErrHalted
+	}
+
+	in := m.program[m.PC]
+	m.PC++
+	m.Steps++
+	if err := m.execute(in); err != nil {
+		m.PC--
+		m.Steps--
+		return &parser.Error{Pos: in.Pos, Err: err}
+	}
+	return nil
+}
+
+// Run executes at most n commands, stopping early if the program halts.
+// It returns the number of commands executed.
+func (m *Machine) Run(n int) (int, error) {
+	for i := 0; i < n; i++ {
+		if m.Halted() {
+			return i, nil
+		}
+		if err := m.Step(); err != nil {
+			return i, err
+		}
+	}
+	return n, nil
+}
+
+// RunUntilHalt executes commands until the program halts,
+// giving up with a *StepLimitError after limit commands.
+func (m *Machine) RunUntilHalt(limit int) error {
+	if _, err := m.Run(limit); err != nil {
+		return err
+	}
+	if !m.Halted() {
+		return &StepLimitError{limit}
+	}
+	return nil
+}
+
+// BreakAt sets a breakpoint on the command at line of the file named filename.
+func (m *Machine) BreakAt(filename string, line int) error {
+	for i, in := range m.program {
+		if in.Pos.Filename == filename && in.Pos.Line == line {
+			m.breakpoints[i] = true
+			return nil
+		}
+	}
+	return fmt.Errorf("vm: no command at %s:%d", filename, line)
+}
+
+// BreakIn sets a breakpoint on the entry of function.
+func (m *Machine) BreakIn(function string) error {
+	entry, ok := m.functions[function]
+	if !ok {
+		return &UndefinedFunctionError{function}
+	}
+	m.breakpoints[entry] = true
+	return nil
+}
+
+// ClearBreakpoints removes all breakpoints.
+func (m *Machine) ClearBreakpoints() {
+	m.breakpoints = make(map[int]bool)
+}
+
+// AtBreakpoint reports whether the next command to execute has a breakpoint.
+func (m *Machine) AtBreakpoint() bool {
+	return !m.Halted() && m.breakpoints[m.PC]
+}
+
+// Continue executes commands until the next one has a breakpoint or the program halts,
+// executing at least one command, and giving up with a *StepLimitError after limit commands.
+func (m *Machine) Continue(limit int) error {
+	for i := 0; i < limit; i++ {
+		if err := m.Step(); err != nil {
+			if err == ErrHalted {
+				return nil
+			}
+			return err
+		}
+		if m.Halted() || m.AtBreakpoint() {
+			return nil
+		}
+	}
+	return &StepLimitError{limit}
+}
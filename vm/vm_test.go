@@ -0,0 +1,332 @@
+package vm
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sato11/the-hack-vm-translator/parser"
+)
+
+// load parses sources, given as file names followed by their code, into a new machine.
+func load(t *testing.T, sources ...string) *Machine {
+	t.Helper()
+	var files []*parser.File
+	for i := 0; i < len(sources); i += 2 {
+		file, err := parser.ParseFile(sources[i], strings.NewReader(sources[i+1]))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		files = append(files, file)
+	}
+	m, err := New(files)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return m
+}
+
+// loadDir parses the .vm files of a directory of testdata into a new machine.
+func loadDir(t *testing.T, dir string) *Machine {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join("..", "testdata", dir, "*.vm"))
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no .vm files in %s: %v", dir, err)
+	}
+	var sources []string
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources = append(sources, path, string(b))
+	}
+	return load(t, sources...)
+}
+
+func TestArithmetic(t *testing.T) {
+	tests := []struct {
+		source string
+		stack  []int16
+	}{
+		{"push constant 7\npush constant 8\nadd", []int16{15}},
+		{"push constant 7\npush constant 8\nsub", []int16{-1}},
+		{"push constant 7\nneg", []int16{-7}},
+		{"push constant 7\npush constant 7\neq", []int16{-1}},
+		{"push constant 7\npush constant 8\ngt", []int16{0}},
+		{"push constant 7\npush constant 8\nlt", []int16{-1}},
+		{"push constant 12\npush constant 10\nand", []int16{8}},
+		{"push constant 12\npush constant 10\nor", []int16{14}},
+		{"push constant 0\nnot", []int16{-1}},
+		{"push constant 32767\npush constant 1\nadd", []int16{-32768}},
+		{"push constant 32767\nneg\npush constant 2\ngt", []int16{0}},
+		{"push constant 32767\npush constant 2\nneg\nlt", []int16{0}},
+	}
+
+	for _, tt := range tests {
+		m := load(t, "Main.vm", tt.source)
+		if err := m.RunUntilHalt(100); err != nil {
+			t.Fatalf("%q: unexpected error: %v", tt.source, err)
+		}
+		if got := m.Stack(); !reflect.DeepEqual(got, tt.stack) {
+			t.Errorf("%q: got stack %v, wanted %v", tt.source, got, tt.stack)
+		}
+	}
+}
+
+func TestSegments(t *testing.T) {
+	m := load(t, "Main.vm", `
+push constant 10
+pop local 0
+push constant 21
+pop argument 1
+push constant 3030
+pop pointer 0
+push constant 3040
+pop pointer 1
+push constant 36
+pop this 6
+push constant 45
+pop that 5
+push constant 510
+pop temp 6
+push local 0
+push that 5
+add
+`)
+	m.Poke(LCL, 300)
+	m.Poke(ARG, 400)
+	if err := m.RunUntilHalt(100); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for address, want := range map[int]int16{300: 10, 401: 21, THIS: 3030, THAT: 3040, 3036: 36, 3045: 45, 11: 510} {
+		if got := m.Peek(address); got != want {
+			t.Errorf("RAM[%d] = %d, wanted %d", address, got, want)
+		}
+	}
+	if got := m.Stack(); !reflect.DeepEqual(got, []int16{55}) {
+		t.Errorf("got stack %v, wanted [55]", got)
+	}
+}
+
+func TestStatics(t *testing.T) {
+	m := load(t,
+		"A.vm", "push constant 1\npop static 0\n",
+		"B.vm", "push constant 2\npop static 0\npush static 0\n",
+	)
+	if err := m.RunUntilHalt(100); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := m.Static("A", 0); got != 1 {
+		t.Errorf("A.0 = %d, wanted 1", got)
+	}
+	if got := m.Static("B", 0); got != 2 {
+		t.Errorf("B.0 = %d, wanted 2", got)
+	}
+	if got := m.Statics(); !reflect.DeepEqual(got, map[string]int16{"A.0": 1, "B.0": 2}) {
+		t.Errorf("got statics %v", got)
+	}
+}
+
+func TestProgramFlow(t *testing.T) {
+	m := loadDir(t, "ProgramFlow/BasicLoop")
+	m.Poke(LCL, 300)
+	m.Poke(ARG, 400)
+	m.Poke(400, 3)
+	if err := m.RunUntilHalt(1000); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := m.Stack(); !reflect.DeepEqual(got, []int16{6}) {
+		t.Errorf("got stack %v, wanted [6]", got)
+	}
+}
+
+func TestFunctionCalls(t *testing.T) {
+	tests := []struct {
+		dir string
+		ram map[int]int16
+	}{
+		{"FunctionCalls/FibonacciElement", map[int]int16{SP: 262, 261: 3}},
+		{"FunctionCalls/StaticsTest", map[int]int16{SP: 263, 261: -2, 262: 8}},
+		{"FunctionCalls/NestedCall", map[int]int16{SP: 261, LCL: 261, ARG: 256, THIS: 4000, THAT: 5000, 5: 135, 6: 246}},
+	}
+
+	for _, tt := range tests {
+		m := loadDir(t, tt.dir)
+		if !m.Defines("Sys.init") {
+			t.Fatalf("%s: Sys.init is not defined", tt.dir)
+		}
+		if err := m.Bootstrap("Sys.init"); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.dir, err)
+		}
+		if err := m.RunUntilHalt(10000); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.dir, err)
+		}
+		for address, want := range tt.ram {
+			if got := m.Peek(address); got != want {
+				t.Errorf("%s: RAM[%d] = %d, wanted %d", tt.dir, address, got, want)
+			}
+		}
+	}
+}
+
+func TestReturnFromBootstrap(t *testing.T) {
+	m := load(t, "Sys.vm", "function Sys.init 0\npush constant 5\nreturn\n")
+	if err := m.Bootstrap("Sys.init"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := m.RunUntilHalt(100); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := m.Stack(); !reflect.DeepEqual(got, []int16{5}) {
+		t.Errorf("got stack %v, wanted [5]", got)
+	}
+	if m.Steps != 3 {
+		t.Errorf("got %d steps, wanted 3", m.Steps)
+	}
+}
+
+func TestStep(t *testing.T) {
+	m := load(t, "Main.vm", "push constant 1\nlabel END\ngoto END\n")
+	for _, want := range []string{"push constant 1", "label END", "goto END"} {
+		if got := m.Command().String(); got != want {
+			t.Errorf("got command %q, wanted %q", got, want)
+		}
+		if err := m.Step(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if !m.Halted() {
+		t.Error("machine has not halted on goto END")
+	}
+	if err := m.Step(); err != ErrHalted {
+		t.Errorf("got %v, wanted ErrHalted", err)
+	}
+}
+
+func TestStepLimit(t *testing.T) {
+	m := load(t, "Main.vm", "label LOOP\npush constant 1\ngoto LOOP\n")
+	err := m.RunUntilHalt(10)
+	var limit *StepLimitError
+	if !errors.As(err, &limit) || limit.Limit != 10 {
+		t.Errorf("got %v, wanted a StepLimitError", err)
+	}
+}
+
+func TestBreakpoints(t *testing.T) {
+	m := load(t, "Sys.vm", `function Sys.init 0
+push constant 1
+call Sys.double 1
+call Sys.double 1
+label END
+goto END
+function Sys.double 0
+push argument 0
+push argument 0
+add
+return
+`)
+	if err := m.Bootstrap("Sys.init"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := m.BreakIn("Sys.double"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := m.BreakAt("Sys.vm", 5); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := m.BreakAt("Sys.vm", 42); err == nil {
+		t.Error("expected an error for a line without command")
+	}
+
+	for _, want := range []string{"Sys.double", "Sys.double", "Sys.init"} {
+		if err := m.Continue(100); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !m.AtBreakpoint() || m.Function() != want {
+			t.Fatalf("stopped in %s at %v, wanted a breakpoint in %s", m.Function(), m.Command(), want)
+		}
+	}
+	if got := m.Peek(261); got != 4 {
+		t.Errorf("got %d on the stack, wanted 4", got)
+	}
+
+	m.ClearBreakpoints()
+	if err := m.Continue(100); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !m.Halted() {
+		t.Error("machine has not halted")
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	file, err := parser.ParseFile("Main.vm", strings.NewReader(`function Main.f 0
+goto NOWHERE
+return
+function Main.f 0
+return
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = New([]*parser.File{file})
+	want := "Main.vm:2:1: goto: undefined label NOWHERE\nMain.vm:4:1: function Main.f defined more than once"
+	list, ok := err.(parser.ErrorList)
+	if !ok {
+		t.Fatalf("got %v, wanted an ErrorList", err)
+	}
+	list.Sort()
+	if list.Error() != want {
+		t.Errorf("got %q, wanted %q", list.Error(), want)
+	}
+}
+
+func TestLabelScopes(t *testing.T) {
+	// each file jumps to its own END, the first one after pushing 1 and the second one 2
+	m := load(t,
+		"A.vm", "push constant 1\ngoto END\nlabel END\ngoto END\n",
+		"B.vm", "push constant 2\ngoto END\nlabel END\ngoto END\n",
+	)
+	if err := m.RunUntilHalt(100); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := m.Stack(); len(got) != 1 || got[0] != 1 {
+		t.Errorf("got: %v wanted: [1]", got)
+	}
+	if got := m.Namespace(); got != "A" {
+		t.Errorf("got: %v wanted: A", got)
+	}
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		err    string
+	}{
+		{"call Foo.bar 0", "Main.vm:1:1: vm: call to undefined function Foo.bar"},
+		{"push constant 1\npop pointer 1\npush that 32767", "Main.vm:3:1: vm: RAM[32768] out of range"},
+		{"pop local 0", "Main.vm:1:1: vm: RAM[-1] out of range"},
+	}
+
+	for _, tt := range tests {
+		m := load(t, "Main.vm", tt.source)
+		m.Poke(THAT, 1000)
+		if tt.source == "pop local 0" {
+			m.Poke(SP, 0)
+		}
+		err := m.RunUntilHalt(100)
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%q: got %v, wanted %s", tt.source, err, tt.err)
+		}
+		var perr *parser.Error
+		if !errors.As(err, &perr) {
+			t.Errorf("%q: got %T, wanted a *parser.Error", tt.source, err)
+		}
+	}
+}